@@ -23,3 +23,22 @@ func (ast Ast) String() string {
 
 	return repr
 }
+
+// AstResult is the serializable form of an Ast, with the unit in its textual form
+type AstResult struct {
+	Kind   string      `json:"kind"`
+	Value  string      `json:"value"`
+	Params []AstResult `json:"params"`
+	Unit   string      `json:"unit"`
+}
+
+// Result returns the Ast in a form suitable for JSON serialization
+func (ast Ast) Result() AstResult {
+	result := AstResult{Kind: ast.Kind, Value: ast.Value, Params: []AstResult{}, Unit: ast.Unit.String()}
+
+	for _, node := range ast.Params {
+		result.Params = append(result.Params, node.Result())
+	}
+
+	return result
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// breakdownUnit is a unit a value can be decomposed into by breakdown
+type breakdownUnit struct {
+	ID     string // ID of the unit in the UnitTable
+	Name   string
+	Plural string
+}
+
+// breakdownUnits are the units breakdown decomposes the values into, from the largest, by base unit
+var breakdownUnits = map[string][]breakdownUnit{
+	"second": {
+		{"year", "year", "years"},
+		{"day", "day", "days"},
+		{"hour", "hour", "hours"},
+		{"minute", "minute", "minutes"},
+		{"second", "second", "seconds"},
+	},
+	"meter": {
+		{"kilometer", "km", "km"},
+		{"meter", "m", "m"},
+		{"centimeter", "cm", "cm"},
+		{"millimeter", "mm", "mm"},
+	},
+}
+
+// Returns the units a value with the given unit is decomposed into, failing if it's not a duration or a length
+func breakdownUnitsOf(unit CompositeUnit) ([]breakdownUnit, error) {
+	if !unit.IsEmpty() {
+		for _, units := range breakdownUnits {
+			largest := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable[units[0].ID], Exponent: 1}}}
+
+			if _, err := ConvertCompositeUnits(1, unit, largest); err == nil {
+				return units, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Breakdown must be applied to a duration or a length")
+}
+
+// Returns whether the line displays its result decomposed in several units, i.e. it is a call to breakdown
+func (line *Line) isBreakdown() bool {
+	ast := line.Ast
+
+	for ast.Kind == "Expression" && ast.Unit.IsEmpty() && len(ast.Params) == 1 {
+		ast = ast.Params[0]
+	}
+
+	return ast.Kind == "Function" && ast.Value == "breakdown"
+}
+
+// Decomposes the value greedily into the largest units that fit it, e.g. 90000 s as `1 day 1 hour`,
+// the remainder being expressed as a decimal of the smallest unit
+func (graph *ExecutionGraph) formatBreakdown(value float64, unit CompositeUnit) string {
+	units, err := breakdownUnitsOf(unit)
+	if err != nil {
+		return err.Error()
+	}
+
+	smallest := units[len(units)-1]
+	remaining, _ := ConvertCompositeUnits(math.Abs(value), unit, CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable[smallest.ID], Exponent: 1}}})
+
+	parts := []string{}
+	for i, part := range units {
+		factor := UnitTable[part.ID].ConversionFactor / UnitTable[smallest.ID].ConversionFactor
+		count := remaining / factor
+
+		// the tiny epsilon avoids turning 3600 s into 59 minutes and 60 seconds because of rounding errors
+		if i < len(units)-1 {
+			count = math.Floor(count + 1e-9)
+			remaining = math.Max(remaining-count*factor, 0)
+		}
+
+		formatted := graph.formatValue(count)
+		if formatted == graph.formatValue(0) {
+			continue
+		}
+
+		if formatted == graph.formatValue(1) {
+			parts = append(parts, formatted+" "+part.Name)
+		} else {
+			parts = append(parts, formatted+" "+part.Plural)
+		}
+	}
+
+	if len(parts) == 0 {
+		return graph.formatValue(0) + " " + smallest.Plural
+	}
+
+	if value < 0 {
+		return "-" + strings.Join(parts, " ")
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -1,3 +1,5 @@
-env GOOS=windows go build -o build/calc-notebook_windows.exe
-env GOOS=darwin go build -o build/calc-notebook_macos
-env GOOS=linux go build -o build/calc-notebook_linux
\ No newline at end of file
+LDFLAGS="-X main.version=$(git describe --tags --always) -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+
+env GOOS=windows go build -ldflags "$LDFLAGS" -o build/calc-notebook_windows.exe
+env GOOS=darwin go build -ldflags "$LDFLAGS" -o build/calc-notebook_macos
+env GOOS=linux go build -ldflags "$LDFLAGS" -o build/calc-notebook_linux
\ No newline at end of file
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// errUnknownUnit signals that the unit of an expression depends on the values, e.g. the exponent of x^n,
+// so it can only be checked by executing it
+var errUnknownUnit = errors.New("The unit depends on the values")
+
+// errStringOperand signals a string used outside of a method, e.g. "a" + 1
+var errStringOperand = errors.New("Strings can only be passed to methods, e.g. ascii \"a\"")
+
+// CheckUnits computes the unit of each line without executing it, setting the error of the lines combining
+// incompatible units, e.g. `5 [m] + 3 [s]`, and returns whether all the lines are free of errors. The lines whose
+// unit depends on the values, e.g. `x [m]^n`, and the lines referring to them are left to the execution
+func (graph *ExecutionGraph) CheckUnits() bool {
+	units := map[int]CompositeUnit{}
+
+	for _, i := range graph.ExecutionOrder {
+		line := &graph.Lines[i]
+		if line.IsEmpty() || line.HasError() {
+			continue
+		}
+
+		unit, err := unitOf(&line.Ast, graph, units)
+
+		if err == errUnknownUnit {
+			continue
+		} else if err != nil {
+			// like the errors of the execution, it is cleared when the line is executed again
+			line.Error = err
+			line.executionFailed = true
+		} else {
+			units[i] = unit
+		}
+	}
+
+	for i := range graph.Lines {
+		if graph.Lines[i].HasError() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Computes the unit of the node without computing the values, applying the same unit rules as executeAst,
+// and returns errUnknownUnit when the unit depends on the values. The units of the referred lines are taken
+// from units, or from the lines themselves if it's nil, i.e. when they have already been executed
+func unitOf(ast *Ast, graph *ExecutionGraph, units map[int]CompositeUnit) (CompositeUnit, error) {
+	if err := graph.checkFunctionAllowed(ast); err != nil {
+		return CompositeUnit{}, err
+	}
+
+	switch ast.Kind {
+	case "NumberLiteral":
+		return CompositeUnit{}, nil
+	case "Variable", "PreviousResult", "LineReference":
+		line, err := graph.referredLine(ast)
+		if err != nil {
+			return CompositeUnit{}, err
+		}
+
+		if units == nil {
+			return graph.Lines[line].Unit, nil
+		}
+
+		unit, ok := units[line]
+		if !ok {
+			return CompositeUnit{}, errUnknownUnit
+		}
+
+		return unit, nil
+	case "Constant":
+		return constantUnit(ast.Value), nil
+	case "Aggregate":
+		totalUnit, count := CompositeUnit{}, 0
+
+		for _, reference := range ast.Params {
+			if err := graph.interrupted(); err != nil {
+				return CompositeUnit{}, err
+			}
+
+			line, _ := strconv.Atoi(reference.Value)
+
+			if graph.Lines[line].IsEmpty() {
+				continue
+			}
+
+			unit, err := unitOf(&reference, graph, units)
+			if err != nil {
+				return CompositeUnit{}, err
+			}
+
+			if totalUnit, err = aggregatedUnit(ast.Value, totalUnit, unit, count, graph.Lines[line]); err != nil {
+				return CompositeUnit{}, err
+			}
+
+			count++
+		}
+
+		return aggregateUnit(ast.Value, totalUnit, count)
+	case "Expression", "Conversion":
+		operand, err := expressionOperand(ast)
+		if err != nil {
+			return CompositeUnit{}, err
+		}
+
+		unit, err := unitOf(operand, graph, units)
+		if err != nil {
+			return CompositeUnit{}, err
+		}
+
+		if ast.Kind == "Conversion" {
+			return conversionUnit(unit, ast.Unit)
+		}
+
+		return expressionUnit(ast, unit)
+	case "Operator":
+		unit1, err := unitOf(&ast.Params[0], graph, units)
+		if err != nil {
+			return CompositeUnit{}, err
+		} else if ast.Value == "!" {
+			return operatorUnit(ast.Value, unit1, CompositeUnit{}, 0)
+		}
+
+		unit2, err := unitOf(&ast.Params[1], graph, units)
+		if err != nil {
+			return CompositeUnit{}, err
+		}
+
+		// the unit of a power depends on the exponent, which is known only if it's written as a number
+		exponent := float64(0)
+		if ast.Value == "^" && unit2.IsEmpty() && !unit1.IsEmpty() {
+			if ast.Params[1].Kind != "NumberLiteral" {
+				return CompositeUnit{}, errUnknownUnit
+			}
+
+			if exponent, _, err = executeAst(&ast.Params[1], graph); err != nil {
+				return CompositeUnit{}, err
+			}
+		}
+
+		return operatorUnit(ast.Value, unit1, unit2, exponent)
+	case "Function":
+		args := []CompositeUnit{}
+
+		for i := range ast.Params {
+			unit, err := unitOf(&ast.Params[i], graph, units)
+			if err != nil {
+				return CompositeUnit{}, err
+			}
+
+			args = append(args, unit)
+		}
+
+		return functionUnit(ast.Value, args)
+	case "Method":
+		return methodUnit(ast)
+	case "String":
+		return CompositeUnit{}, errStringOperand
+	}
+
+	return CompositeUnit{}, fmt.Errorf("Unrecognized expression %s", ast.Kind)
+}
+
+// The unit rules below are shared by executeAst and unitOf, so that the execution and the check of the units
+// report the same errors
+
+// Returns an error if the node calls a function the graph does not permit
+func (graph *ExecutionGraph) checkFunctionAllowed(ast *Ast) error {
+	if (ast.Kind == "Function" || ast.Kind == "Method" || ast.Kind == "Aggregate") && !graph.functionAllowed(ast.Value) {
+		return fmt.Errorf("Function %s is not permitted", ast.Value)
+	}
+
+	return nil
+}
+
+// Returns the line a Variable, PreviousResult or LineReference node refers to, failing if it's empty or has an error
+func (graph *ExecutionGraph) referredLine(ast *Ast) (int, error) {
+	if ast.Kind == "Variable" {
+		line := graph.Variables[ast.Value]
+
+		if graph.Lines[line].IsEmpty() {
+			return 0, fmt.Errorf("Referring to a variable defined by empty expression")
+		} else if graph.Lines[line].HasError() {
+			return 0, fmt.Errorf("Referring to a variable whose definition has an error")
+		}
+
+		return line, nil
+	}
+
+	// the line is resolved only for ordinary lines, e.g. not for unit declarations
+	line, err := strconv.Atoi(ast.Value)
+	if err != nil {
+		return 0, fmt.Errorf("Line references cannot be used here")
+	}
+
+	if graph.Lines[line].IsEmpty() {
+		return 0, fmt.Errorf("Referring to line %d, which is empty", graph.Lines[line].SourceLine+1)
+	} else if graph.Lines[line].HasError() {
+		return 0, fmt.Errorf("Referring to line %d, which has an error", graph.Lines[line].SourceLine+1)
+	}
+
+	return line, nil
+}
+
+// Returns the unit of a constant, e.g. m / s for the speed of light
+func constantUnit(name string) CompositeUnit {
+	if constant, ok := PhysicalConstants[name]; ok {
+		// a copy, so that the operations on the result leave the constant untouched
+		return CompositeUnitExponentiation(constant.Unit, 1)
+	}
+
+	return CompositeUnit{}
+}
+
+// Returns the unit of an aggregate after adding the line with the given unit, which is the unit of the first line
+func aggregatedUnit(aggregate string, totalUnit CompositeUnit, unit CompositeUnit, count int, line Line) (CompositeUnit, error) {
+	if count == 0 {
+		return unit, nil
+	}
+
+	if _, err := ConvertCompositeUnits(1, unit, totalUnit); err != nil {
+		return CompositeUnit{}, fmt.Errorf("Cannot add line %d to the %s: %s", line.SourceLine+1, aggregate, err)
+	}
+
+	return totalUnit, nil
+}
+
+// Returns the unit of the result of an aggregate over count non-empty lines
+func aggregateUnit(aggregate string, totalUnit CompositeUnit, count int) (CompositeUnit, error) {
+	switch aggregate {
+	case "sum":
+		return totalUnit, nil
+	case "avg":
+		if count == 0 {
+			return CompositeUnit{}, fmt.Errorf("The range of avg contains only empty lines")
+		}
+
+		return totalUnit, nil
+	}
+
+	return CompositeUnit{}, fmt.Errorf("Unknown aggregate %s", aggregate)
+}
+
+// Returns the unit of an expression followed by a unit, which is given to a number with no unit
+// and otherwise converts the result
+func expressionUnit(ast *Ast, unit CompositeUnit) (CompositeUnit, error) {
+	if ast.Unit.IsEmpty() {
+		return unit, nil
+	}
+
+	if unit.IsEmpty() {
+		return ast.Unit, nil
+	}
+
+	if _, err := ConvertCompositeUnitsExplicitly(1, unit, ast.Unit); err != nil {
+		return CompositeUnit{}, fmt.Errorf("Cannot convert %s to %s", unit, ast.Unit)
+	}
+
+	return ast.Unit, nil
+}
+
+// Returns the unit of an explicit conversion, e.g. `x in [km]`
+func conversionUnit(unit CompositeUnit, target CompositeUnit) (CompositeUnit, error) {
+	if unit.IsEmpty() {
+		return CompositeUnit{}, fmt.Errorf("Cannot convert a number with no unit to %s", target)
+	}
+
+	if _, err := ConvertCompositeUnitsExplicitly(1, unit, target); err != nil {
+		return CompositeUnit{}, fmt.Errorf("Cannot convert %s to %s", unit, target)
+	}
+
+	return target, nil
+}
+
+// Returns the unit of the result of an operator, the exponent is used only by ^ and unit2 is ignored by !
+func operatorUnit(operator string, unit1 CompositeUnit, unit2 CompositeUnit, exponent float64) (CompositeUnit, error) {
+	switch operator {
+	case "!":
+		if !unit1.IsEmpty() {
+			return CompositeUnit{}, fmt.Errorf("Factorial must be applied to a number with no unit")
+		}
+
+		return CompositeUnit{}, nil
+	case "+", "-":
+		// the second operand is an interval, e.g. 5 [°C] + 3 [K] is 8 °C
+		_, err := ConvertCompositeUnitsInterval(1, unit2, unit1)
+		return unit1, err
+	case "*":
+		_, unit := CompositeUnitProduct(1, 1, unit1, unit2)
+		return unit, checkShiftedProduct(unit1, unit2, unit)
+	case "/":
+		_, unit := CompositeUnitDivision(1, 1, unit1, unit2)
+		return unit, checkShiftedProduct(unit1, unit2, unit)
+	case "^":
+		if !unit2.IsEmpty() {
+			return CompositeUnit{}, fmt.Errorf("Exponent must be a number with no unit")
+		}
+
+		unit := CompositeUnitExponentiation(unit1, exponent)
+		return unit, checkShiftedProduct(unit1, CompositeUnit{}, unit)
+	}
+
+	return CompositeUnit{}, fmt.Errorf("Unknown operation %s", operator)
+}
+
+// Returns an error if the units with an offset, like °C, are combined in a product, a division or a power,
+// which is meaningful only when the result is a plain temperature, e.g. (5 [°C]) * 2 or (5 [°C/hour]) * (2 [hours])
+func checkShiftedProduct(unit1 CompositeUnit, unit2 CompositeUnit, result CompositeUnit) error {
+	if !unit1.hasOffsetScale() && !unit2.hasOffsetScale() {
+		return nil
+	}
+
+	if unit1.hasOffsetScale() != unit2.hasOffsetScale() && len(result.UnitsList) == 1 &&
+		result.UnitsList[0].Exponent == 1 && result.hasOffsetScale() {
+		return nil
+	}
+
+	return fmt.Errorf("Units with an offset, like temperatures, cannot be combined with other units or raised to a power")
+}
+
+// Returns the unit of the result of a function called with arguments of the given units
+func functionUnit(function string, args []CompositeUnit) (CompositeUnit, error) {
+	expectedArgs, ok := functionArgumentsCount[function]
+	if !ok {
+		expectedArgs = []int{1}
+	}
+
+	if !containsInt(expectedArgs, len(args)) {
+		return CompositeUnit{}, fmt.Errorf("Function %s called with the wrong number of arguments", function)
+	}
+
+	unit := args[0]
+
+	switch function {
+	case "clamp", "hypot", "percentchange":
+		// the other arguments are converted to the unit of the first one
+		for _, other := range args[1:] {
+			if _, err := ConvertCompositeUnits(1, other, unit); err != nil {
+				return CompositeUnit{}, err
+			}
+		}
+
+		if function == "percentchange" {
+			return CompositeUnit{}, nil
+		}
+
+		return unit, nil
+	case "factorial":
+		return operatorUnit("!", unit, CompositeUnit{}, 0)
+	case "ncr", "npr":
+		if !args[0].IsEmpty() || !args[1].IsEmpty() {
+			return CompositeUnit{}, fmt.Errorf("Arguments of %s must be numbers with no unit", function)
+		}
+
+		return CompositeUnit{}, nil
+	case "sqrt":
+		result := CompositeUnitExponentiation(unit, 0.5)
+		return result, checkShiftedProduct(unit, CompositeUnit{}, result)
+	case "sin", "cos", "tan":
+		// the argument is an angle, numbers with no unit being radians
+		if !unit.IsEmpty() && !unit.isAngle() {
+			return CompositeUnit{}, fmt.Errorf("Units are not compatible")
+		}
+
+		return CompositeUnit{}, nil
+	case "degrees", "radians":
+		to := UnitTable[function]
+		toUnit := CompositeUnit{UnitsList: []UnitExponent{{Unit: to, Exponent: 1}}}
+
+		// numbers with no unit are assumed to be expressed in the other angle unit
+		if !unit.IsEmpty() {
+			if _, err := ConvertCompositeUnits(1, unit, toUnit); err != nil {
+				return CompositeUnit{}, err
+			}
+		}
+
+		return toUnit, nil
+	case "round":
+		if len(args) == 2 && !args[1].IsEmpty() {
+			return CompositeUnit{}, fmt.Errorf("The decimal places of round must be a non-negative integer")
+		}
+
+		return unit, nil
+	case "breakdown":
+		// the value is kept, breakdown only changes how the result of the line is displayed
+		_, err := breakdownUnitsOf(unit)
+		return unit, err
+	case "log", "ln", "abs", "ceil", "floor", "trunc", "frac":
+		return unit, nil
+	}
+
+	return CompositeUnit{}, fmt.Errorf("Unknown function %s", function)
+}
+
+// Returns the operand of an Expression or Conversion, failing for the empty ones, e.g. () or a line with just a unit
+func expressionOperand(ast *Ast) (*Ast, error) {
+	if len(ast.Params) == 0 {
+		return nil, errors.New("The expression is empty")
+	}
+
+	return &ast.Params[0], nil
+}
+
+// Returns the unit of the result of a method, checking its argument
+func methodUnit(ast *Ast) (CompositeUnit, error) {
+	switch ast.Value {
+	case "ascii":
+		if len(ast.Params) == 0 || ast.Params[0].Kind != "String" {
+			return CompositeUnit{}, fmt.Errorf("You must pass a string to the ascii method")
+		} else if ast.Params[0].Value == "" {
+			return CompositeUnit{}, fmt.Errorf("You must pass a non-empty string to the ascii method")
+		}
+
+		return CompositeUnit{}, nil
+	}
+
+	return CompositeUnit{}, fmt.Errorf("Unknown method %s", ast.Value)
+}
+
+// ErrorMessages returns the error of each line that has one, followed by its position, e.g.
+// `Units are not compatible (line 3)` or `Units are not compatible (calc.cal:3)` if the graph has SourceFiles,
+// the syntax errors including the column
+func (graph *ExecutionGraph) ErrorMessages() []string {
+	messages := []string{}
+
+	for _, line := range graph.Lines {
+		if _, ok := line.Error.(SyntaxError); ok {
+			messages = append(messages, line.Error.Error())
+		} else if line.HasError() {
+			if file, number := graph.sourcePosition(line.SourceLine); file != "" {
+				messages = append(messages, fmt.Sprintf("%s (%s:%d)", line.Error, file, number))
+			} else {
+				messages = append(messages, fmt.Sprintf("%s (line %d)", line.Error, number))
+			}
+		}
+	}
+
+	return messages
+}
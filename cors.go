@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Returns whether the origin matches one of the allowed ones, where `*` allows every origin and
+// an origin ending in `:*` allows every port, e.g. `http://localhost:*`
+func isAllowedOrigin(origin string, allowedOrigins []string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		if strings.HasSuffix(allowed, ":*") && strings.HasPrefix(origin, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CORSMiddleware adds the CORS headers for the allowed origins and answers the preflight requests
+func CORSMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+
+		if origin != "" && isAllowedOrigin(origin, allowedOrigins) {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Content-Type, Accept")
+			c.Header("Vary", "Origin")
+		}
+
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
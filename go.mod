@@ -2,4 +2,7 @@ module github.com/ZaninAndrea/calc-notebook
 
 go 1.14
 
-require github.com/gin-gonic/gin v1.6.3 // indirect
+require (
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/gin-gonic/gin v1.6.3
+)
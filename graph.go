@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"html"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Line contains the compiled data for one line of code
 type Line struct {
+	SourceLine   int     // index of the line of source code containing it, which can contain several statements
 	Name         string  // it's name as variable, if assigned
 	Tokens       []Token // it's tokenization
 	RawTokens    []Token // tokenization including whitespace and comment
@@ -17,6 +22,119 @@ type Line struct {
 	Ast          Ast
 	Unit         CompositeUnit
 	Error        error
+
+	executionFailed bool // whether the Error comes from the execution, so it is cleared when executing again
+}
+
+// LineResult returns the textual result of a line: its value and unit, `! error` or X for empty lines,
+// preceded by the name of the variable it defines, e.g. `speed: 5.000000 m / s`
+func (graph *ExecutionGraph) LineResult(line *Line) string {
+	name := ""
+	if line.Name != "" {
+		name = line.Name + ": "
+	}
+
+	if line.HasError() {
+		return fmt.Sprintf("%s! %s", name, line.Error)
+	} else if line.IsEmpty() {
+		return name + "X"
+	} else if line.isBreakdown() {
+		return name + graph.formatBreakdown(line.Value, line.Unit)
+	}
+
+	unitString := line.Unit.String()
+
+	if unitString != "" {
+		unitString = " " + unitString
+	}
+
+	return name + graph.formatValue(line.Value) + unitString
+}
+
+// Formats a value for display with the Precision of the graph, or up to 6 decimals without trailing zeros,
+// in scientific notation for the very small and very large values, and, if enabled, the thousands separators
+// of its locale
+func (graph *ExecutionGraph) formatValue(value float64) string {
+	// very small and very large values are displayed in scientific notation, e.g. 6.62607015e-34 for h,
+	// since the fixed decimals would display them as 0 or with hundreds of digits
+	magnitude := math.Abs(value)
+	scientific := magnitude != 0 && !math.IsInf(value, 0) && (magnitude < 1e-4 || magnitude >= 1e21)
+
+	formatted := ""
+	if graph.Precision > 0 && scientific {
+		formatted = strconv.FormatFloat(value, 'e', graph.Precision-1, 64)
+	} else if graph.Precision > 0 {
+		rounded, decimals := roundToSignificant(value, graph.Precision)
+		formatted = fmt.Sprintf("%.*f", int(math.Max(float64(decimals), 0)), rounded)
+	} else if scientific {
+		formatted = strconv.FormatFloat(value, 'g', 10, 64)
+	} else {
+		// values within a tiny relative epsilon of an integer are displayed as the integer,
+		// e.g. 5 instead of 4.9999999998
+		if math.Abs(value-math.Round(value)) < 1e-9*magnitude {
+			value = math.Round(value)
+		}
+		if value == 0 {
+			value = 0 // avoids displaying -0
+		}
+
+		formatted = strings.TrimRight(fmt.Sprintf("%f", roundToDecimal(value, 13)), "0")
+		formatted = strings.TrimSuffix(formatted, ".")
+	}
+
+	// infinities are displayed as they are, since they have no digits to group
+	if !graph.ThousandsSeparators || math.IsInf(value, 0) || math.IsNaN(value) {
+		return formatted
+	}
+
+	thousandsSeparator, decimalSeparator := graph.separators()
+
+	return groupThousands(formatted, thousandsSeparator, decimalSeparator)
+}
+
+// Returns the thousands and decimal separators of the number literals
+func (graph *ExecutionGraph) separators() (string, string) {
+	if graph.DecimalSeparator == "." {
+		return ",", "."
+	}
+
+	return ".", ","
+}
+
+// Returns whether the line ends with a unit, either converting its result, e.g. `x [N m]`, or giving it
+// to a number, e.g. `5 [N m]`
+func (line *Line) hasWrittenUnit() bool {
+	return line.Ast.Kind == "Conversion" || !line.Ast.Unit.IsEmpty()
+}
+
+// Returns whether the line ends by converting its result to a unit, e.g. `x [km]` or `x in [km]`,
+// as opposed to giving a unit to a number, e.g. `5 [km]`
+func (line *Line) hasExplicitConversion() bool {
+	if line.Ast.Kind == "Conversion" {
+		return true
+	}
+
+	if line.Ast.Unit.IsEmpty() {
+		return false
+	}
+
+	return len(line.Ast.Params) != 1 || line.Ast.Params[0].Kind != "NumberLiteral"
+}
+
+// SyntaxError is an error located at a character of the source code
+type SyntaxError struct {
+	File    string // name of the source file, empty if the source code is not split in files
+	Line    int    // counting from 1
+	Column  int    // counting from 1, 0 means the end of the line
+	Message string
+}
+
+func (err SyntaxError) Error() string {
+	if err.File != "" {
+		return fmt.Sprintf("%s (%s:%d, column %d)", err.Message, err.File, err.Line, err.Column)
+	}
+
+	return fmt.Sprintf("%s (line %d, column %d)", err.Message, err.Line, err.Column)
 }
 
 // IsEmpty returns whether the Line contains an empty expression
@@ -34,121 +152,305 @@ type ExecutionGraph struct {
 	Lines          []Line
 	Variables      map[string]int // map from variable to the corresponding line
 	ExecutionOrder []int
+	Dependents     [][]int // for each line, the lines depending on it
 	SourceCode     string
+	Units          map[string]FundamentalUnit // units declared in the source code, by name
+
+	// CurrencyRates overrides the rates of the currencies relative to the euro, by currency ID, for this graph only
+	CurrencyRates map[string]float64
+
+	// Precision is the number of significant digits of the displayed results, 0 keeps the default formatting
+	Precision int
+
+	// SimplifyUnits expresses the results as named derived units when possible, e.g. kg m / s^2 as N, except for
+	// the lines ending with a unit, which is kept as written, e.g. a torque in `(10 [N]) * (2 [m]) [N m]`
+	SimplifyUnits bool
+
+	// ScalePrefixes expresses single metric units with the SI prefix that brings the value between 1 and 1000,
+	// e.g. 0,0000034 m as 3,4 μm
+	ScalePrefixes bool
+
+	// ThousandsSeparators groups the digits of the displayed results, using the separators of DecimalSeparator
+	ThousandsSeparators bool
+
+	// AllowInfinity lets divisions by zero and other operations result in infinities instead of errors
+	AllowInfinity bool
+
+	// DecimalSeparator is the character used for decimals in number literals, either "," (the default) or ".",
+	// the other one is used as thousands separator
+	DecimalSeparator string
+
+	// AllowedFunctions restricts the Functions, Methods and Aggregates the source code can call, nil allows all of them
+	AllowedFunctions []string
+
+	// AllowedUnits restricts the units of the UnitTable the source code can use, by ID, nil allows all of them
+	AllowedUnits []string
+
+	// AllowedConstants restricts the Constants and PhysicalConstants the source code can use, nil allows all of them
+	AllowedConstants []string
+
+	// SourceFiles are the files concatenated, one after the other, into the SourceCode, so that the positions are
+	// reported as a file and a line within it, nil reports the lines of the SourceCode
+	SourceFiles []SourceFile
+
+	// ctx interrupts the execution when it's done, it's set only while ExecuteContext or PlotContext are running
+	ctx context.Context
+}
+
+// Returns the error of the context of the running execution if it's done, e.g. because of a timeout
+func (graph *ExecutionGraph) interrupted() error {
+	if graph.ctx == nil {
+		return nil
+	}
+
+	return graph.ctx.Err()
+}
+
+// SourceFile is a file whose content is part of the SourceCode of a graph
+type SourceFile struct {
+	Name  string
+	Lines int // number of lines of the file
+}
+
+// Functions lists the functions of the language, e.g. sqrt(4)
+var Functions = []string{"sqrt", "log", "ln", "sin", "cos", "tan", "abs", "round", "ceil", "floor", "trunc", "frac", "degrees", "radians", "clamp", "hypot", "factorial", "ncr", "npr", "percentchange", "breakdown"}
+
+// Methods lists the functions applied to the whole expression that follows them, e.g. ascii "a"
+var Methods = []string{"ascii"}
+
+// Aggregates lists the functions computed over a range of lines, e.g. sum(line1, line5)
+var Aggregates = []string{"sum", "avg"}
+
+// Constants lists the named constants of the language
+var Constants = []string{"pi", "e", "tau", "phi"}
+
+// PhysicalConstant is a constant carrying a unit, e.g. the speed of light in m / s
+type PhysicalConstant struct {
+	Value float64
+	Unit  CompositeUnit
+}
+
+// PhysicalConstants are the physical constants by name, a variable with the same name overrides them
+var PhysicalConstants = map[string]PhysicalConstant{
+	// speed of light
+	"c": {299_792_458, CompositeUnit{[]UnitExponent{{UnitTable["meter"], 1}, {UnitTable["second"], -1}}}},
+	// standard gravity
+	"g": {9.80665, CompositeUnit{[]UnitExponent{{UnitTable["meter"], 1}, {UnitTable["second"], -2}}}},
+	// Planck constant
+	"h": {6.62607015e-34, CompositeUnit{[]UnitExponent{{UnitTable["joule"], 1}, {UnitTable["second"], 1}}}},
+	// Boltzmann constant
+	"k_B": {1.380649e-23, CompositeUnit{[]UnitExponent{{UnitTable["joule"], 1}, {UnitTable["kelvin"], -1}}}},
+	// Avogadro constant
+	"N_A": {6.02214076e23, CompositeUnit{[]UnitExponent{{UnitTable["mole"], -1}}}},
+}
+
+// Returns whether the AllowedFunctions of the graph permit calling the function
+func (graph *ExecutionGraph) functionAllowed(name string) bool {
+	return graph.AllowedFunctions == nil || containsString(graph.AllowedFunctions, name)
+}
+
+// Returns whether the AllowedConstants of the graph permit using the constant
+func (graph *ExecutionGraph) constantAllowed(name string) bool {
+	return graph.AllowedConstants == nil || containsString(graph.AllowedConstants, name)
+}
+
+// Returns whether the AllowedUnits of the graph permit using the unit with the given ID
+func (graph *ExecutionGraph) unitAllowed(id string) bool {
+	return graph.AllowedUnits == nil || containsString(graph.AllowedUnits, id)
 }
 
-// ParseCode parses a sourcecode into an ExecutionGraph
-func ParseCode(sourceCode string) ExecutionGraph {
+// ParseCode parses a sourcecode into an ExecutionGraph, failing if the definitions are cyclical
+func ParseCode(sourceCode string) (ExecutionGraph, error) {
 	graph := ExecutionGraph{SourceCode: sourceCode}
+	err := graph.Parse()
+
+	return graph, err
+}
 
+// Parse parses the SourceCode of the graph, failing if the definitions are cyclical
+func (graph *ExecutionGraph) Parse() error {
 	graph.Tokenize(false)
+	graph.parseUnitDeclarations()
 	graph.parseVariableDeclarations()
-	graph.parseLineDependencies()
-
-	if graph.hasCyclicalDependencies() {
-		panic("Cyclical definitions detected")
-	}
 
-	graph.findExecutionOrder()
+	sourceLines := strings.Split(graph.SourceCode, "\n")
 
 	for i := range graph.Lines {
-		ast, err := parser(graph.Lines[i].Tokens, graph.Variables)
+		ast, err := parser(graph.Lines[i].Tokens, graph)
+		sourceLine := graph.Lines[i].SourceLine
 
 		if err != nil {
-			graph.Lines[i].Error = err
+			graph.Lines[i].Error = graph.locateError(err, sourceLine, sourceLines[sourceLine])
 		} else {
 			graph.Lines[i].Ast = ast
 		}
 	}
 
-	return graph
+	graph.parseLineDependencies()
+
+	if cycle := graph.findCyclicalDependencies(); cycle != nil {
+		names := []string{}
+		for _, line := range append(cycle, cycle[0]) {
+			names = append(names, graph.Lines[line].Name)
+		}
+
+		return fmt.Errorf("Cyclical definitions detected: %s", strings.Join(names, " -> "))
+	}
+
+	graph.findExecutionOrder()
+
+	return nil
 }
 
 // Tokenize computes the token representation of each line
 func (graph *ExecutionGraph) Tokenize(allowUnknown bool) *ExecutionGraph {
-	for _, line := range strings.Split(graph.SourceCode, "\n") {
+	for i, line := range strings.Split(graph.SourceCode, "\n") {
 		tokens, err := tokenizer(line, allowUnknown)
 
 		if err != nil {
-			graph.Lines = append(graph.Lines, Line{Error: err})
-		} else {
-			graph.Lines = append(graph.Lines, Line{Tokens: removeNonSemanticTokens(tokens), RawTokens: tokens})
+			graph.Lines = append(graph.Lines, Line{SourceLine: i, Error: graph.locateError(err, i, line)})
+			continue
+		}
+
+		for _, statement := range splitStatements(tokens) {
+			graph.Lines = append(graph.Lines, Line{SourceLine: i, Tokens: removeNonSemanticTokens(statement), RawTokens: statement})
 		}
 	}
 
 	return graph
 }
 
-// Parse a line of code into a list of tokens
-func tokenizer(source string, allowUnknown bool) ([]Token, error) {
+// Splits the tokens of a line of code into the statements separated by semicolons, each keeping its semicolon
+func splitStatements(tokens []Token) [][]Token {
+	statements := [][]Token{{}}
+
+	for _, token := range tokens {
+		last := len(statements) - 1
+		statements[last] = append(statements[last], token)
+
+		if token.Kind == "terminator" {
+			statements = append(statements, []Token{})
+		}
+	}
+
+	// a trailing semicolon, possibly followed by a comment, does not start a new statement
+	if last := len(statements) - 1; last > 0 && len(removeNonSemanticTokens(statements[last])) == 0 {
+		statements[last-1] = append(statements[last-1], statements[last]...)
+		statements = statements[:last]
+	}
+
+	return statements
+}
+
+// Parse a line of code into a list of tokens, positioned by character (not byte) offset
+func tokenizer(line string, allowUnknown bool) ([]Token, error) {
+	source := []rune(line)
 	current := 0
 	tokens := []Token{}
 
-	digits := []byte("0123456789")
-	numberChars := []byte("0123456789.,%")
-
-	literalStartChars := []byte("qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM_")
-	literalChars := []byte("qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM_0123456789")
+	digits := []rune("0123456789")
+	numberChars := []rune("0123456789.,%")
 
-	operators := []byte("+-*/^")
+	// ! is the postfix factorial, a future != operator must be matched before it (longest match first)
+	operators := []rune("+-*/^!")
+	// the currency symbols are tokens of their own, so that they can precede or follow a number, e.g. £10 or 10 £
+	currencies := []rune("£€¥$")
 
 	for current < len(source) {
+		start := current
 		char := source[current]
 
 		// Everything after the comment marker is ignored
 		if char == '#' {
-			tokens = append(tokens, Token{"comment", source[current:]})
+			tokens = append(tokens, Token{"comment", string(source[current:]), start, len(source)})
 
 			break
 		}
 
-		// skip whitespace
-		if char == ' ' || char == '\t' {
-			val := ""
-
-			for current < len(source) && (source[current] == ' ' || source[current] == '\t') {
-				val += string(source[current])
+		// skip whitespace, stray carriage returns from CRLF line endings included
+		if char == ' ' || char == '\t' || char == '\r' {
+			for current < len(source) && (source[current] == ' ' || source[current] == '\t' || source[current] == '\r') {
 				current++
 			}
 
-			tokens = append(tokens, Token{"whitespace", val})
+			tokens = append(tokens, Token{"whitespace", string(source[start:current]), start, current})
 			continue
 		}
 
 		// match open and close parenthesis and definitions
 		if char == '(' {
-			tokens = append(tokens, Token{"paren", "("})
+			tokens = append(tokens, Token{"paren", "(", start, start + 1})
 
 			current++
 			continue
 		}
 		if char == ')' {
-			tokens = append(tokens, Token{"paren", ")"})
+			tokens = append(tokens, Token{"paren", ")", start, start + 1})
 
 			current++
 			continue
 		}
 		if char == ':' {
-			tokens = append(tokens, Token{"definition", ":"})
+			tokens = append(tokens, Token{"definition", ":", start, start + 1})
+
+			current++
+			continue
+		}
+		// a future == comparison must be matched before the = definition (longest match first)
+		if char == '=' {
+			tokens = append(tokens, Token{"definition", "=", start, start + 1})
+
+			current++
+			continue
+		}
+		if char == ';' {
+			tokens = append(tokens, Token{"terminator", ";", start, start + 1})
+
+			current++
+			continue
+		}
+		if char == '|' {
+			tokens = append(tokens, Token{"bar", "|", start, start + 1})
+
+			current++
+			continue
+		}
+		if char == ',' {
+			tokens = append(tokens, Token{"separator", ",", start, start + 1})
 
 			current++
 			continue
 		}
 		if char == '[' {
-			tokens = append(tokens, Token{"bracket", "["})
+			tokens = append(tokens, Token{"bracket", "[", start, start + 1})
 
 			current++
 			continue
 		}
 		if char == ']' {
-			tokens = append(tokens, Token{"bracket", "]"})
+			tokens = append(tokens, Token{"bracket", "]", start, start + 1})
+
+			current++
+			continue
+		}
+
+		// ** is the exponentiation, as in Python
+		if char == '*' && current+1 < len(source) && source[current+1] == '*' {
+			tokens = append(tokens, Token{"operator", "**", start, start + 2})
+
+			current += 2
+			continue
+		}
+
+		if containsRune(operators, char) {
+			tokens = append(tokens, Token{"operator", string(char), start, start + 1})
 
 			current++
 			continue
 		}
 
-		if containsByte(operators, char) {
-			tokens = append(tokens, Token{"operator", string(char)})
+		if containsRune(currencies, char) {
+			tokens = append(tokens, Token{"currency", string(char), start, start + 1})
 
 			current++
 			continue
@@ -156,89 +458,116 @@ func tokenizer(source string, allowUnknown bool) ([]Token, error) {
 
 		// match a string
 		if char == '"' {
-			value := ""
 			current++
-			char = source[current]
 
-			for char != '"' {
-				value += string(char)
+			for current < len(source) && source[current] != '"' {
 				current++
+			}
 
-				if current >= len(source) {
-					return nil, fmt.Errorf("unterminated string")
-				}
-
-				char = source[current]
+			if current >= len(source) {
+				return nil, SyntaxError{Column: start + 1, Message: "Unterminated string"}
 			}
 
 			current++
-			tokens = append(tokens, Token{"string", value})
+			tokens = append(tokens, Token{"string", string(source[start+1 : current-1]), start, current})
 
 			continue
 		}
 
+		// match a hexadecimal or binary integer
+		if char == '0' && current+2 < len(source) {
+			prefix := source[current+1]
+			prefixDigits := []rune{}
+
+			if prefix == 'x' || prefix == 'X' {
+				prefixDigits = []rune("0123456789abcdefABCDEF")
+			} else if prefix == 'b' || prefix == 'B' {
+				prefixDigits = []rune("01")
+			}
+
+			if len(prefixDigits) > 0 && containsRune(prefixDigits, source[current+2]) {
+				current += 2
+
+				for current < len(source) && containsRune(prefixDigits, source[current]) {
+					current++
+				}
+
+				tokens = append(tokens, Token{"number", string(source[start:current]), start, current})
+
+				continue
+			}
+		}
+
 		// match a number
-		if containsByte(digits, char) {
-			value := ""
+		if containsRune(digits, char) {
+			for current < len(source) && containsRune(numberChars, source[current]) {
+				// a comma not followed by a digit separates function arguments
+				if source[current] == ',' && (current+1 >= len(source) || !containsRune(digits, source[current+1])) {
+					break
+				}
 
-			for containsByte(numberChars, char) {
-				value += string(char)
 				current++
 
-				if current >= len(source) {
+				// the percent sign ends the number, e.g. 50%2 is not a single number
+				if source[current-1] == '%' {
 					break
 				}
-
-				char = source[current]
 			}
 
-			tokens = append(tokens, Token{"number", value})
+			tokens = append(tokens, Token{"number", string(source[start:current]), start, current})
 
 			continue
 		}
 
 		// match a variable
-		if containsByte(literalStartChars, char) {
-			value := ""
-
-			for containsByte(literalChars, char) {
-				value += string(char)
+		if isLiteralStart(char) {
+			for current < len(source) && (isLiteralStart(source[current]) || containsRune(digits, source[current])) {
 				current++
-
-				if current >= len(source) {
-					break
-				}
-
-				char = source[current]
 			}
 
-			tokens = append(tokens, Token{"literal", value})
+			tokens = append(tokens, Token{"literal", string(source[start:current]), start, current})
 
 			continue
 		}
 
 		// handling unknown characters
 		if char == '\n' {
-			panic("Tokenizer should parse single lines, \\n found")
+			return nil, fmt.Errorf("Tokenizer should parse single lines, \\n found")
 		}
 
 		if allowUnknown {
-			tokens = append(tokens, Token{"unknown", string(char)})
+			tokens = append(tokens, Token{"unknown", string(char), start, start + 1})
 			current++
 
 			continue
 		}
-		return nil, fmt.Errorf("Unknown character " + string(char))
+		return nil, SyntaxError{Column: start + 1, Message: "Unknown character " + string(char)}
 	}
 
 	return tokens, nil
 }
 
+// Completes the position of syntax errors with the line they occurred in
+func (graph *ExecutionGraph) locateError(err error, line int, source string) error {
+	syntaxError, ok := err.(SyntaxError)
+
+	if !ok {
+		return err
+	}
+
+	syntaxError.File, syntaxError.Line = graph.sourcePosition(line)
+	if syntaxError.Column == 0 {
+		syntaxError.Column = utf8.RuneCountInString(source) + 1
+	}
+
+	return syntaxError
+}
+
 func removeNonSemanticTokens(tokens []Token) []Token {
 	filteredSlice := []Token{}
 
 	for i := range tokens {
-		if tokens[i].Kind != "comment" && tokens[i].Kind != "whitespace" {
+		if tokens[i].Kind != "comment" && tokens[i].Kind != "whitespace" && tokens[i].Kind != "terminator" {
 			filteredSlice = append(filteredSlice, tokens[i])
 		}
 	}
@@ -246,140 +575,393 @@ func removeNonSemanticTokens(tokens []Token) []Token {
 	return filteredSlice
 }
 
-// Check which lines are declaring a variable
-func (graph *ExecutionGraph) parseVariableDeclarations() {
-	graph.Variables = map[string]int{}
-	for i := range graph.Lines {
-		line := &graph.Lines[i]
-		if len(line.Tokens) > 1 && line.Tokens[0].Kind == "literal" && line.Tokens[1].Kind == "definition" {
-			graph.Variables[line.Tokens[0].Value] = i
-			line.Name = line.Tokens[0].Value
+// Check which lines are declaring a custom unit, e.g. `unit furlong = 201,168 [m]`, and register them in order of appearance
+func (graph *ExecutionGraph) parseUnitDeclarations() {
+	graph.Units = map[string]FundamentalUnit{}
+	sourceLines := strings.Split(graph.SourceCode, "\n")
 
-			line.Tokens = line.Tokens[2:]
-		}
+	for i := range graph.Lines {
+		graph.parseUnitDeclaration(i, sourceLines[graph.Lines[i].SourceLine])
 	}
 }
 
-// For every line find which variables it references
-func (graph *ExecutionGraph) parseLineDependencies() {
-	for i := range graph.Lines {
-		line := &graph.Lines[i]
+// Registers the unit declared by the given line, if any
+func (graph *ExecutionGraph) parseUnitDeclaration(i int, source string) {
+	line := &graph.Lines[i]
 
-		// loop over all tokens and check if they are variable literals
-		for _, token := range line.Tokens {
-			if token.Kind == "literal" {
-				val, ok := graph.Variables[token.Value]
+	if isUnitDeclaration(line.Tokens) {
+		name := line.Tokens[1].Value
+		line.Tokens = line.Tokens[3:]
 
-				if ok {
-					line.Dependencies = append(line.Dependencies, val)
-				}
-			}
+		unit, err := graph.declareUnit(name, line.Tokens)
+		if err != nil {
+			line.Error = graph.locateError(err, line.SourceLine, source)
+			return
 		}
+
+		graph.Units[name] = unit
 	}
 }
 
-// Checks if there are cycles in the dependency graph
-func (graph *ExecutionGraph) hasCyclicalDependencies() bool {
-	dt := make([]int, len(graph.Lines))
-	ft := make([]int, len(graph.Lines))
-	step := 1
+// Checks whether the tokens declare a custom unit, e.g. `unit furlong = 201,168 [m]`
+func isUnitDeclaration(tokens []Token) bool {
+	return len(tokens) > 2 && tokens[0].Kind == "literal" && tokens[0].Value == "unit" &&
+		tokens[1].Kind == "literal" && tokens[2].Kind == "definition"
+}
 
-	for i := range graph.Lines {
-		if dt[i] == 0 {
-			if recHasCycles(graph, &dt, &ft, i, &step) {
-				return true
-			}
-		}
+// Computes the custom unit defined by the given expression, which must not reference any variable
+func (graph *ExecutionGraph) declareUnit(name string, tokens []Token) (FundamentalUnit, error) {
+	if _, ok := UnitAliasesMap[name]; ok {
+		return FundamentalUnit{}, fmt.Errorf("Unit %s is already defined", name)
+	}
+	if _, ok := graph.Units[name]; ok {
+		return FundamentalUnit{}, fmt.Errorf("Unit %s is already defined", name)
 	}
 
-	return false
-}
+	if len(tokens) == 0 {
+		return FundamentalUnit{}, fmt.Errorf("Unit %s is defined by an empty expression", name)
+	}
 
-// Uses a Depth First Search to look for cycles in the directed graph given by the dependencies
-func recHasCycles(graph *ExecutionGraph, dt *[]int, ft *[]int, node int, step *int) bool {
-	(*dt)[node] = *step
-	(*step)++
+	ast, err := parser(tokens, graph)
+	if err != nil {
+		return FundamentalUnit{}, err
+	}
 
-	for _, n := range graph.Lines[node].Dependencies {
-		// If the node hasn't been visited call recursively, if it has check if this edge closes a loop
-		if (*dt)[n] == 0 {
-			if recHasCycles(graph, dt, ft, n, step) {
-				return true
-			}
-		} else if (*ft)[n] == 0 {
-			return true
+	value, unit, err := executeAst(&ast, graph)
+	if err != nil {
+		return FundamentalUnit{}, err
+	}
+
+	for _, factor := range unit.UnitsList {
+		if factor.Unit.ConversionShift != 0 {
+			return FundamentalUnit{}, fmt.Errorf("Units cannot be defined relative to %s", factor.Unit)
 		}
 	}
 
-	(*ft)[node] = *step
-	(*step)++
+	// the new unit shares the base unit of the definition, which must be a single (possibly derived) base unit
+	baseUnit := ""
+	for _, candidate := range unit.UnitsList {
+		if (CompositeUnit{UnitsList: []UnitExponent{{candidate.Unit, 1}}}).IsCompatible(unit) {
+			baseUnit = candidate.Unit.BaseUnit
+		}
+	}
+	for derived := range DerivedBaseUnits {
+		if (CompositeUnit{UnitsList: []UnitExponent{{FundamentalUnit{BaseUnit: derived}, 1}}}).IsCompatible(unit) {
+			baseUnit = derived
+		}
+	}
 
-	return false
-}
+	if baseUnit == "" {
+		return FundamentalUnit{}, fmt.Errorf("Units must be defined relative to a known unit")
+	}
 
-// Computes a topological order in the dependencies graph
-func (graph *ExecutionGraph) findExecutionOrder() {
-	visited := make([]bool, len(graph.Lines))
-	order := []int{}
+	return FundamentalUnit{
+		ID:               name,
+		DisplayValue:     name,
+		Aliases:          []string{name},
+		BaseUnit:         baseUnit,
+		ConversionFactor: value * unit.conversionFactor(),
+		ConversionShift:  0,
+	}, nil
+}
 
+// Check which lines are declaring a variable
+func (graph *ExecutionGraph) parseVariableDeclarations() {
+	graph.Variables = map[string]int{}
 	for i := range graph.Lines {
-		if !visited[i] {
-			recTopologicalOrder(graph, i, &order, &visited)
+		if parseVariableDeclaration(&graph.Lines[i]) {
+			graph.Variables[graph.Lines[i].Name] = i
 		}
 	}
+}
+
+// Names the line after the variable it declares with `name: expression` or `name = expression`, if any,
+// removing the declaration from its tokens
+func parseVariableDeclaration(line *Line) bool {
+	if len(line.Tokens) > 1 && line.Tokens[0].Kind == "literal" && line.Tokens[1].Kind == "definition" {
+		line.Name = line.Tokens[0].Value
+		line.Tokens = line.Tokens[2:]
+
+		return true
+	}
 
-	graph.ExecutionOrder = order
+	return false
 }
 
-// Computes a topological order using a Depth First Visit of the graph, appending values in post-order
-func recTopologicalOrder(graph *ExecutionGraph, line int, order *[]int, visited *[]bool) {
-	// Add to the order first all the depended lines (if not already added)
-	for _, l := range graph.Lines[line].Dependencies {
-		if !(*visited)[l] {
-			recTopologicalOrder(graph, l, order, visited)
+// For every line find which lines it references, through variables or the previous result
+func (graph *ExecutionGraph) parseLineDependencies() {
+	graph.Dependents = make([][]int, len(graph.Lines))
+
+	for i := range graph.Lines {
+		line := &graph.Lines[i]
+
+		if line.HasError() {
+			continue
+		}
+
+		if err := graph.resolveReferences(&line.Ast, i); err != nil {
+			line.Error = err
 		}
 	}
+}
 
-	// Then add to the order this line
-	(*order) = append(*order, line)
-	(*visited)[line] = true
+// Adds a dependency to a line, keeping track of the reverse dependency
+func (graph *ExecutionGraph) addDependency(line int, dependency int) {
+	graph.Lines[line].Dependencies = append(graph.Lines[line].Dependencies, dependency)
+	graph.Dependents[dependency] = append(graph.Dependents[dependency], line)
 }
 
-func parser(tokens []Token, variables map[string]int) (Ast, error) {
-	functions := []string{"sqrt", "log", "ln", "sin", "cos", "tan", "abs", "ln", "round", "ceil", "floor"}
-	methods := []string{"ascii"}
-	constants := []string{"pi", "e"}
+// Walks the AST of a line adding the referenced lines to its dependencies
+func (graph *ExecutionGraph) resolveReferences(ast *Ast, line int) error {
+	if ast.Kind == "Variable" {
+		graph.addDependency(line, graph.Variables[ast.Value])
+	}
 
-	current := 0
+	if ast.Kind == "PreviousResult" {
+		previous := graph.previousResultLine(line)
 
-	walkUnit := func() (Ast, error) {
-		if current >= len(tokens) {
-			return Ast{}, fmt.Errorf("Line ends unexpectedly")
+		if previous < 0 {
+			return fmt.Errorf("There is no previous result to refer to with ans")
 		}
 
-		token := tokens[current]
+		ast.Value = strconv.Itoa(previous)
+		graph.addDependency(line, previous)
+	}
 
-		if token.Kind == "number" {
-			current++
+	if ast.Kind == "LineReference" {
+		sourceLine, _ := strconv.Atoi(ast.Value)
 
-			return Ast{Kind: "UnitNumberLiteral", Value: token.Value}, nil
+		referenced, err := graph.referencedLine(sourceLine, line)
+		if err != nil {
+			return err
 		}
 
-		// literals can be known units or unknown units
-		if token.Kind == "literal" {
-			if val, ok := UnitAliasesMap[token.Value]; ok {
-				current++
+		ast.Value = strconv.Itoa(referenced)
+		graph.addDependency(line, referenced)
+	}
 
-				return Ast{Kind: "FundamentalUnit", Value: val}, nil
-			} else {
-				current++
+	// the bounds of the range are replaced by a reference to each line in the range
+	if ast.Kind == "Aggregate" {
+		from, _ := strconv.Atoi(ast.Params[0].Value)
+		to, _ := strconv.Atoi(ast.Params[1].Value)
 
-				return Ast{Kind: "CustomUnit", Value: token.Value}, nil
-			}
+		if from > to {
+			return fmt.Errorf("The range of %s must start before it ends", ast.Value)
 		}
 
-		if token.Kind == "operator" && token.Value == "^" {
-			current++
+		references := []Ast{}
+		for sourceLine := from; sourceLine <= to; sourceLine++ {
+			referenced, err := graph.referencedLine(sourceLine, line)
+			if err != nil {
+				return err
+			}
+
+			references = append(references, Ast{Kind: "LineReference", Value: strconv.Itoa(referenced)})
+			graph.addDependency(line, referenced)
+		}
+
+		ast.Params = references
+
+		return nil
+	}
+
+	for i := range ast.Params {
+		if err := graph.resolveReferences(&ast.Params[i], line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the file containing the given line of the SourceCode, empty if the graph has no SourceFiles,
+// and the number of the line within it, counting from 1
+func (graph *ExecutionGraph) sourcePosition(sourceLine int) (string, int) {
+	line := sourceLine
+
+	for _, file := range graph.SourceFiles {
+		if line < file.Lines {
+			return file.Name, line + 1
+		}
+
+		line -= file.Lines
+	}
+
+	return "", sourceLine + 1
+}
+
+// Finds the statement referred to by the index of a line of code, i.e. its last statement,
+// checking that it is above the referring line
+func (graph *ExecutionGraph) referencedLine(sourceLine int, line int) (int, error) {
+	referenced := -1
+	for i := range graph.Lines {
+		if graph.Lines[i].SourceLine == sourceLine {
+			referenced = i
+		}
+	}
+
+	if referenced < 0 {
+		return 0, fmt.Errorf("Line %d does not exist", sourceLine+1)
+	}
+	if referenced >= line {
+		return 0, fmt.Errorf("Lines can only refer to the lines above them")
+	}
+
+	return referenced, nil
+}
+
+// Finds the closest line above the given one that is not empty and has no syntax error, -1 if there is none
+func (graph *ExecutionGraph) previousResultLine(line int) int {
+	for i := line - 1; i >= 0; i-- {
+		if !graph.Lines[i].IsEmpty() && !graph.Lines[i].HasError() {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Checks if there are cycles in the dependency graph, returning the lines forming the first cycle found
+func (graph *ExecutionGraph) findCyclicalDependencies() []int {
+	dt := make([]int, len(graph.Lines))
+	ft := make([]int, len(graph.Lines))
+	step := 1
+	path := []int{}
+
+	for i := range graph.Lines {
+		if dt[i] == 0 {
+			if cycle := recFindCycle(graph, &dt, &ft, i, &step, &path); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sets the error of the lines forming cyclical definitions, e.g. for the /ast of code that cannot be executed,
+// removing their dependencies so that the other cycles are found too
+func (graph *ExecutionGraph) markCyclicalDependencies() {
+	for cycle := graph.findCyclicalDependencies(); cycle != nil; cycle = graph.findCyclicalDependencies() {
+		names := []string{}
+		for _, line := range append(cycle, cycle[0]) {
+			names = append(names, graph.Lines[line].Name)
+		}
+
+		for _, line := range cycle {
+			graph.Lines[line].Error = fmt.Errorf("Cyclical definitions detected: %s", strings.Join(names, " -> "))
+			graph.Lines[line].Dependencies = nil
+		}
+	}
+}
+
+// Uses a Depth First Search to look for cycles in the directed graph given by the dependencies,
+// path keeps the lines currently being visited so that the cycle can be reconstructed
+func recFindCycle(graph *ExecutionGraph, dt *[]int, ft *[]int, node int, step *int, path *[]int) []int {
+	(*dt)[node] = *step
+	(*step)++
+	(*path) = append(*path, node)
+
+	for _, n := range graph.Lines[node].Dependencies {
+		// If the node hasn't been visited call recursively, if it has check if this edge closes a loop
+		if (*dt)[n] == 0 {
+			if cycle := recFindCycle(graph, dt, ft, n, step, path); cycle != nil {
+				return cycle
+			}
+		} else if (*ft)[n] == 0 {
+			for i := range *path {
+				if (*path)[i] == n {
+					return append([]int{}, (*path)[i:]...)
+				}
+			}
+		}
+	}
+
+	(*ft)[node] = *step
+	(*step)++
+	(*path) = (*path)[:len(*path)-1]
+
+	return nil
+}
+
+// Computes a topological order in the dependencies graph
+func (graph *ExecutionGraph) findExecutionOrder() {
+	visited := make([]bool, len(graph.Lines))
+	order := []int{}
+
+	for i := range graph.Lines {
+		if !visited[i] {
+			recTopologicalOrder(graph, i, &order, &visited)
+		}
+	}
+
+	graph.ExecutionOrder = order
+}
+
+// Computes a topological order using a Depth First Visit of the graph, appending values in post-order
+func recTopologicalOrder(graph *ExecutionGraph, line int, order *[]int, visited *[]bool) {
+	// Add to the order first all the depended lines (if not already added)
+	for _, l := range graph.Lines[line].Dependencies {
+		if !(*visited)[l] {
+			recTopologicalOrder(graph, l, order, visited)
+		}
+	}
+
+	// Then add to the order this line
+	(*order) = append(*order, line)
+	(*visited)[line] = true
+}
+
+func parser(tokens []Token, graph *ExecutionGraph) (Ast, error) {
+	current := 0
+	// the closing delimiters expected by the open parentheses, brackets and bars, the innermost last
+	closers := []string{}
+
+	// locates an error at the token being parsed, or at the end of the line if every token was consumed
+	locate := func(err error) error {
+		if _, ok := err.(SyntaxError); ok {
+			return err
+		}
+
+		if current < len(tokens) {
+			return SyntaxError{Column: tokens[current].Start + 1, Message: err.Error()}
+		}
+
+		return SyntaxError{Message: err.Error()}
+	}
+
+	walkUnit := func() (Ast, error) {
+		if current >= len(tokens) {
+			return Ast{}, fmt.Errorf("Line ends unexpectedly")
+		}
+
+		token := tokens[current]
+
+		if token.Kind == "number" {
+			current++
+
+			return Ast{Kind: "UnitNumberLiteral", Value: token.Value}, nil
+		}
+
+		// literals can be known units or unknown units, while currency symbols are always known
+		if token.Kind == "literal" || token.Kind == "currency" {
+			if val, ok := UnitAliasesMap[token.Value]; ok {
+				if !graph.unitAllowed(val) {
+					return Ast{}, fmt.Errorf("Unit %s is not permitted", token.Value)
+				}
+
+				current++
+
+				return Ast{Kind: "FundamentalUnit", Value: val}, nil
+			} else {
+				current++
+
+				return Ast{Kind: "CustomUnit", Value: token.Value}, nil
+			}
+		}
+
+		if token.Kind == "operator" && token.Value == "^" {
+			current++
 
 			return Ast{Kind: "UnitExponent", Value: token.Value}, nil
 		}
@@ -388,11 +970,133 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 
 			return Ast{Kind: "UnitDivision", Value: token.Value}, nil
 		}
+		if token.Kind == "operator" && token.Value == "*" {
+			current++
+
+			return Ast{Kind: "UnitProduct", Value: token.Value}, nil
+		}
+		if token.Kind == "paren" {
+			current++
+
+			return Ast{Kind: "UnitParen", Value: token.Value}, nil
+		}
 
 		return Ast{}, fmt.Errorf("Unrecognized unit syntax")
 	}
 
 	var walk func() (Ast, error)
+
+	// A unit following a number gives its unit to the number alone, e.g. speed * 2 [hours] multiplies speed
+	// by (2 [hours]), while it applies to the whole expression otherwise, e.g. x [km] converts x to km,
+	// and after an exponent, e.g. 3 * 10^8 [m/s]
+	applyUnit := func(expression *Ast, unit CompositeUnit) {
+		params := expression.Params
+		last := len(params) - 1
+		isOperator := func(i int, operator string) bool {
+			return i >= 0 && params[i].Kind == "RawOperator" && params[i].Value == operator
+		}
+
+		if last < 0 || params[last].Kind != "NumberLiteral" || isOperator(last-1, "^") {
+			expression.Unit = unit
+			return
+		}
+
+		// the negation of the number is kept with it, e.g. 2 * -5 [m] is 2 * (-5 [m])
+		first := last
+		if isOperator(last-1, "-") && (last == 1 || (params[last-2].Kind == "RawOperator" && params[last-2].Value != "!")) {
+			first = last - 1
+		}
+
+		number := Ast{Kind: "Expression", Params: append([]Ast{}, params[first:]...), Unit: unit}
+		expression.Params = append(append([]Ast{}, params[:first]...), number)
+	}
+
+	// A number followed by a unit and nothing else is the expression in that unit, e.g. (5 [km]), so that
+	// the unit stays written at the end of the expression
+	liftUnit := func(expression *Ast) {
+		if len(expression.Params) == 1 && expression.Unit.IsEmpty() && expression.Params[0].Kind == "Expression" {
+			*expression = expression.Params[0]
+		}
+	}
+
+	// Adjacent operands are implicitly multiplied, e.g. 2pi or 3(4+1)
+	appendOperand := func(params []Ast, content Ast) ([]Ast, error) {
+		endsWithOperand := len(params) > 0 &&
+			(params[len(params)-1].Kind != "RawOperator" || params[len(params)-1].Value == "!")
+
+		if endsWithOperand && content.Kind != "RawOperator" {
+			if content.Kind == "NumberLiteral" {
+				return nil, fmt.Errorf("Missing operator before number %s", content.Value)
+			}
+
+			params = append(params, Ast{Kind: "RawOperator", Value: "*"})
+		}
+
+		return append(params, content), nil
+	}
+
+	// Match a parenthesized list of comma separated arguments, each parsed as an Expression
+	walkArguments := func() ([]Ast, error) {
+		current++
+		closers = append(closers, ")")
+
+		args := []Ast{}
+		arg := Ast{Kind: "Expression", Params: []Ast{}}
+
+		for {
+			if current >= len(tokens) {
+				return nil, fmt.Errorf("Line ends unexpectedly")
+			}
+
+			token := tokens[current]
+
+			if token.Kind == "separator" || (token.Kind == "paren" && token.Value == ")") {
+				if len(arg.Params) == 0 {
+					return nil, fmt.Errorf("Function called with an empty argument")
+				}
+
+				liftUnit(&arg)
+				args = append(args, arg)
+				current++
+
+				if token.Kind == "paren" {
+					closers = closers[:len(closers)-1]
+					return args, nil
+				}
+
+				arg = Ast{Kind: "Expression", Params: []Ast{}}
+				continue
+			}
+
+			content, err := walk()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if content.Kind != "UnitExpression" {
+				arg.Params, err = appendOperand(arg.Params, content)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				applyUnit(&arg, content.Unit)
+			}
+		}
+	}
+
+	// a currency symbol gives its unit to the number it precedes or follows, e.g. £10 or 10 £ is (10 [£])
+	walkCurrency := func(number Token, currency Token) (Ast, error) {
+		id := UnitAliasesMap[currency.Value]
+		if !graph.unitAllowed(id) {
+			return Ast{}, fmt.Errorf("Unit %s is not permitted", currency.Value)
+		}
+
+		unit := CompositeUnit{UnitsList: []UnitExponent{{Unit: graph.fundamentalUnit(id), Exponent: 1}}}
+
+		return Ast{Kind: "Expression", Params: []Ast{{Kind: "NumberLiteral", Value: number.Value}}, Unit: unit}, nil
+	}
+
 	walk = func() (Ast, error) {
 		if current >= len(tokens) {
 			return Ast{}, fmt.Errorf("Line ends unexpectedly")
@@ -403,18 +1107,44 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 		if token.Kind == "number" {
 			current++
 
+			if current < len(tokens) && tokens[current].Kind == "currency" {
+				current++
+
+				return walkCurrency(token, tokens[current-1])
+			}
+
 			return Ast{Kind: "NumberLiteral", Value: token.Value}, nil
 		}
 
+		if token.Kind == "currency" {
+			if current+1 >= len(tokens) || tokens[current+1].Kind != "number" {
+				return Ast{}, fmt.Errorf("The currency symbol %s must precede or follow a number, e.g. %s10", token.Value, token.Value)
+			}
+
+			current += 2
+
+			return walkCurrency(tokens[current-1], token)
+		}
+
 		if token.Kind == "string" {
 			current++
 
 			return Ast{Kind: "String", Value: token.Value}, nil
 		}
 
+		// a closing delimiter ends the loop of the matching opening one, so reaching it here means it does not match
+		if (token.Kind == "paren" && token.Value == ")") || (token.Kind == "bracket" && token.Value == "]") {
+			if len(closers) == 0 {
+				return Ast{}, fmt.Errorf("Unmatched %s", token.Value)
+			}
+
+			return Ast{}, fmt.Errorf("Mismatched %s, expected %s", token.Value, closers[len(closers)-1])
+		}
+
 		// Match all the tokens inside the parenthesis
 		if token.Kind == "paren" && token.Value == "(" {
 			current++
+			closers = append(closers, ")")
 
 			if current >= len(tokens) {
 				return Ast{}, fmt.Errorf("Line ends unexpectedly")
@@ -432,9 +1162,12 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 				}
 
 				if content.Kind != "UnitExpression" {
-					ast.Params = append(ast.Params, content)
+					ast.Params, err = appendOperand(ast.Params, content)
+					if err != nil {
+						return Ast{}, err
+					}
 				} else {
-					ast.Unit = content.Unit
+					applyUnit(&ast, content.Unit)
 				}
 
 				if current >= len(tokens) {
@@ -444,10 +1177,56 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 			}
 
 			current++
+			closers = closers[:len(closers)-1]
+			liftUnit(&ast)
 
 			return ast, nil
 		}
 
+		// Match all the tokens between absolute value bars, which cannot be nested
+		if token.Kind == "bar" {
+			current++
+			closers = append(closers, "|")
+
+			ast := Ast{Kind: "Expression", Params: []Ast{}}
+
+			for {
+				if current >= len(tokens) {
+					return Ast{}, fmt.Errorf("Line ends unexpectedly")
+				}
+
+				if tokens[current].Kind == "bar" {
+					break
+				}
+
+				content, err := walk()
+
+				if err != nil {
+					return Ast{}, err
+				}
+
+				if content.Kind != "UnitExpression" {
+					ast.Params, err = appendOperand(ast.Params, content)
+					if err != nil {
+						return Ast{}, err
+					}
+				} else {
+					applyUnit(&ast, content.Unit)
+				}
+			}
+
+			// an empty content or a trailing operator means that the closing bar was meant to open a nested one
+			if len(ast.Params) == 0 || (ast.Params[len(ast.Params)-1].Kind == "RawOperator" && ast.Params[len(ast.Params)-1].Value != "!") {
+				return Ast{}, fmt.Errorf("Absolute value bars cannot be empty or nested")
+			}
+
+			current++
+			closers = closers[:len(closers)-1]
+			liftUnit(&ast)
+
+			return Ast{Kind: "Function", Value: "abs", Params: []Ast{ast}}, nil
+		}
+
 		// Match all the tokens inside the brackets
 		if token.Kind == "bracket" && token.Value == "[" {
 			current++
@@ -459,8 +1238,39 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 			token = tokens[current]
 
 			ast := Ast{Kind: "UnitExpression", Params: []Ast{}}
+			// the parentheses open inside the brackets
+			depth := 0
+
+			// an alias spanning several tokens, e.g. L/100km, is a single unit when it fills the brackets
+			alias, end := "", current
+			for end < len(tokens) && tokens[end].Kind != "bracket" {
+				alias += tokens[end].Value
+				end++
+			}
+			if id, ok := UnitAliasesMap[alias]; ok && end-current > 1 && end < len(tokens) && tokens[end].Value == "]" {
+				if !graph.unitAllowed(id) {
+					return Ast{}, fmt.Errorf("Unit %s is not permitted", alias)
+				}
+
+				ast.Params = []Ast{{Kind: "FundamentalUnit", Value: id}}
+				current = end
+				token = tokens[current]
+			}
+
+			for token.Kind != "bracket" || token.Value != "]" || depth > 0 {
+				if token.Kind == "bracket" && token.Value == "]" {
+					return Ast{}, fmt.Errorf("Mismatched ], expected )")
+				}
+				if token.Kind == "paren" && token.Value == "(" {
+					depth++
+				}
+				if token.Kind == "paren" && token.Value == ")" {
+					if depth == 0 {
+						return Ast{}, fmt.Errorf("Mismatched ), expected ]")
+					}
+					depth--
+				}
 
-			for token.Kind != "bracket" || token.Value != "]" {
 				content, err := walkUnit()
 
 				if err != nil {
@@ -474,7 +1284,7 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 				token = tokens[current]
 			}
 
-			unit, err := parseUnitAst(ast)
+			unit, err := parseUnitAst(ast, graph)
 
 			if err != nil {
 				return Ast{}, err
@@ -485,43 +1295,137 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 			return ast, nil
 		}
 
+		// `15% of 200` multiplies the percentage by the following terms
+		if token.Kind == "literal" && token.Value == "of" && current > 0 &&
+			tokens[current-1].Kind == "number" && strings.HasSuffix(tokens[current-1].Value, "%") {
+			current++
+
+			return Ast{Kind: "RawOperator", Value: "*"}, nil
+		}
+
 		// literals can be constants, variables or functions
 		if token.Kind == "literal" {
-			if containsString(constants, token.Value) {
+			if containsString(Constants, token.Value) {
+				if !graph.constantAllowed(token.Value) {
+					return Ast{}, fmt.Errorf("Constant %s is not permitted", token.Value)
+				}
+
 				current++
 
 				return Ast{Kind: "Constant", Value: token.Value}, nil
 			}
 
-			if _, ok := variables[token.Value]; ok {
+			if _, ok := graph.Variables[token.Value]; ok {
 				current++
 
 				return Ast{Kind: "Variable", Value: token.Value}, nil
 			}
 
-			if containsString(functions, token.Value) {
-				ast := Ast{Kind: "Function", Value: token.Value}
+			// the physical constants come after the variables, so that defining e.g. c keeps working
+			if _, ok := PhysicalConstants[token.Value]; ok {
+				if !graph.constantAllowed(token.Value) {
+					return Ast{}, fmt.Errorf("Constant %s is not permitted", token.Value)
+				}
 
 				current++
 
-				if current >= len(tokens) {
-					return Ast{}, fmt.Errorf("Line ends unexpectedly")
-				}
+				return Ast{Kind: "Constant", Value: token.Value}, nil
+			}
 
-				token = tokens[current]
+			// ans refers to the result of the previous line, the line number is resolved with the dependencies
+			if token.Value == "ans" {
+				current++
 
-				content, err := walk()
+				return Ast{Kind: "PreviousResult"}, nil
+			}
+
+			// lineN refers to the result of the N-th line (counting from 1)
+			if number, ok := parseLineReference(token.Value); ok {
+				current++
+
+				return Ast{Kind: "LineReference", Value: strconv.Itoa(number - 1)}, nil
+			}
+
+			isFunction := containsString(Functions, token.Value) || containsString(Methods, token.Value) || containsString(Aggregates, token.Value)
+			if isFunction && !graph.functionAllowed(token.Value) {
+				return Ast{}, fmt.Errorf("Function %s is not permitted", token.Value)
+			}
+
+			// aggregates are computed over a range of lines, e.g. sum(line1, line5)
+			if containsString(Aggregates, token.Value) {
+				name := token.Value
+				rangeError := fmt.Errorf("%s takes a range of lines, e.g. %s(line1, line5)", name, name)
+
+				current++
+
+				if current >= len(tokens) || tokens[current].Kind != "paren" || tokens[current].Value != "(" {
+					return Ast{}, rangeError
+				}
+
+				args, err := walkArguments()
 
 				if err != nil {
 					return Ast{}, err
 				}
 
+				if len(args) != 2 {
+					return Ast{}, rangeError
+				}
+
+				bounds := []Ast{}
+				for _, arg := range args {
+					if len(arg.Params) != 1 || arg.Params[0].Kind != "LineReference" || !arg.Unit.IsEmpty() {
+						return Ast{}, rangeError
+					}
+
+					bounds = append(bounds, arg.Params[0])
+				}
+
+				return Ast{Kind: "Aggregate", Value: name, Params: bounds}, nil
+			}
+
+			if containsString(Functions, token.Value) {
+				ast := Ast{Kind: "Function", Value: token.Value}
+
+				current++
+
+				if current >= len(tokens) {
+					return Ast{}, fmt.Errorf("Line ends unexpectedly")
+				}
+
+				token = tokens[current]
+
+				// a parenthesis opens the list of arguments, otherwise the function is applied to the next term
+				if token.Kind == "paren" && token.Value == "(" {
+					args, err := walkArguments()
+
+					if err != nil {
+						return Ast{}, err
+					}
+
+					ast.Params = args
+
+					return ast, nil
+				}
+
+				content, err := walk()
+
+				if err != nil {
+					return Ast{}, err
+				}
+
+				// without parentheses the argument is a single term, so an operator next to it would be ambiguous,
+				// e.g. sqrt 4 + 5 could mean sqrt(4) + 5 or sqrt(4 + 5)
+				if content.Kind == "RawOperator" || (current < len(tokens) && tokens[current].Kind == "operator") {
+					return Ast{}, fmt.Errorf("Operators next to the argument of %s require parentheses, e.g. %s(4 + 5)", ast.Value, ast.Value)
+				}
+
 				ast.Params = []Ast{content}
 
 				return ast, nil
 			}
 
-			if containsString(methods, token.Value) {
+			if containsString(Methods, token.Value) {
 				ast := Ast{Kind: "Method", Value: token.Value}
 
 				current++
@@ -547,11 +1451,17 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 				return ast, nil
 
 			}
+
+			return Ast{}, fmt.Errorf("Undefined variable '%s'", token.Value)
 		}
 
 		if token.Kind == "operator" {
 			current++
 
+			if token.Value == "**" {
+				return Ast{Kind: "RawOperator", Value: "^"}, nil
+			}
+
 			return Ast{Kind: "RawOperator", Value: token.Value}, nil
 		}
 
@@ -559,22 +1469,54 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 	}
 
 	ast := &Ast{Kind: "Expression", Params: []Ast{}}
+	conversions := []CompositeUnit{}
 
 	for current < len(tokens) {
+		token := tokens[current]
+
+		// `expression in [unit]` and `expression to [unit]` convert the whole expression to the unit
+		if token.Kind == "literal" && (token.Value == "in" || token.Value == "to") &&
+			current+1 < len(tokens) && tokens[current+1].Kind == "bracket" && tokens[current+1].Value == "[" {
+			current++
+
+			content, err := walk()
+
+			if err != nil {
+				return Ast{}, locate(err)
+			}
+
+			conversions = append(conversions, content.Unit)
+			continue
+		}
+
+		if len(conversions) > 0 {
+			return Ast{}, locate(fmt.Errorf("Unit conversions must be at the end of the expression"))
+		}
+
 		content, err := walk()
 
 		if err != nil {
-			return Ast{}, err
+			return Ast{}, locate(err)
 		}
 
 		if content.Kind != "UnitExpression" {
-			ast.Params = append(ast.Params, content)
+			ast.Params, err = appendOperand(ast.Params, content)
+			if err != nil {
+				return Ast{}, locate(err)
+			}
 		} else {
-			ast.Unit = content.Unit
+			applyUnit(ast, content.Unit)
 		}
 	}
 
-	for _, operator := range []string{"^", "*", "/", "-", "+"} {
+	if len(conversions) > 0 && len(ast.Params) == 0 {
+		return Ast{}, fmt.Errorf("Missing expression to convert")
+	}
+
+	liftUnit(ast)
+	groupUnaryMinus(ast)
+
+	for _, operator := range []string{"!", "^", "*", "/", "-", "+"} {
 		newAst, err := parseOperator(ast, operator)
 
 		if err != nil {
@@ -584,78 +1526,289 @@ func parser(tokens []Token, variables map[string]int) (Ast, error) {
 		ast = newAst
 	}
 
+	for _, unit := range conversions {
+		ast = &Ast{Kind: "Conversion", Params: []Ast{*ast}, Unit: unit}
+	}
+
 	return *ast, nil
 }
 
-func parseUnitAst(ast Ast) (CompositeUnit, error) {
-	cu := CompositeUnit{}
+// ParseUnit parses the textual form of a unit, e.g. `km` or `m/s^2`
+func ParseUnit(source string) (CompositeUnit, error) {
+	return (&ExecutionGraph{}).ParseUnit(source)
+}
 
-	// TODO: give error on m^2^3
+// ParseUnit parses the textual form of a unit like the package-level ParseUnit, applying the currency rates of the graph
+func (graph *ExecutionGraph) ParseUnit(source string) (CompositeUnit, error) {
+	if strings.TrimSpace(source) == "" {
+		return CompositeUnit{}, fmt.Errorf("The unit is empty")
+	}
 
-	exponentSign := float64(1)
+	tokens, err := tokenizer("["+source+"]", false)
 
-	curr := 0
+	if err != nil {
+		return CompositeUnit{}, err
+	}
 
-	for curr < len(ast.Params) {
-		token := ast.Params[curr]
+	ast, err := parser(removeNonSemanticTokens(tokens), graph)
 
-		if token.Kind == "FundamentalUnit" {
-			cu.UnitsList = append(cu.UnitsList, UnitExponent{UnitTable[token.Value], exponentSign})
-			curr++
-			continue
-		}
+	if err != nil {
+		return CompositeUnit{}, err
+	}
 
-		if token.Kind == "CustomUnit" {
-			cu.UnitsList = append(cu.UnitsList, UnitExponent{FundamentalUnit{
-				ID:               token.Value,
-				DisplayValue:     token.Value,
-				Aliases:          []string{token.Value},
-				BaseUnit:         token.Value,
-				ConversionFactor: 1,
-				ConversionShift:  0,
-			}, exponentSign})
-			curr++
-			continue
-		}
+	if ast.Kind != "Expression" || len(ast.Params) > 0 {
+		return CompositeUnit{}, fmt.Errorf("%s is not a unit", source)
+	}
 
-		if token.Kind == "UnitDivision" && exponentSign == 1 {
-			exponentSign = -1
+	return ast.Unit, nil
+}
 
-			curr++
-			continue
+// Returns the unit of the UnitTable with the given ID, applying the currency rates of the graph
+func (graph *ExecutionGraph) fundamentalUnit(id string) FundamentalUnit {
+	unit := UnitTable[id]
+
+	if rate, ok := graph.CurrencyRates[id]; ok {
+		unit.ConversionFactor = 1 / rate
+	}
+
+	return unit
+}
+
+// UnitsByBaseUnit lists the units of the UnitTable, with the currency rates of the graph, and the units declared
+// by its source code grouped by their base unit and sorted by ID
+func (graph *ExecutionGraph) UnitsByBaseUnit() map[string][]UnitResult {
+	groups := map[string][]UnitResult{}
+
+	add := func(unit FundamentalUnit) {
+		result := UnitResult{unit.ID, unit.DisplayValue, unit.Aliases, 0}
+		if unit.BaseUnit == "eur" {
+			result.Rate = 1 / unit.ConversionFactor
 		}
 
-		if token.Kind == "UnitExponent" && len(cu.UnitsList) > 0 {
-			curr++
+		groups[unit.BaseUnit] = append(groups[unit.BaseUnit], result)
+	}
+
+	for id := range UnitTable {
+		add(graph.fundamentalUnit(id))
+	}
+	for _, unit := range graph.Units {
+		add(unit)
+	}
+
+	for _, units := range groups {
+		sort.Slice(units, func(i int, j int) bool {
+			return units[i].ID < units[j].ID
+		})
+	}
+
+	return groups
+}
+
+func parseUnitAst(ast Ast, graph *ExecutionGraph) (CompositeUnit, error) {
+	curr := 0
+
+	var parseGroup func() (CompositeUnit, error)
+
+	// Parses the units up to the end of the expression or of the current parenthesis, a division puts only
+	// the following unit or parenthesized group in the denominator, e.g. kg*m/s/A is kg m / (s A)
+	parseGroup = func() (CompositeUnit, error) {
+		cu := CompositeUnit{}
 
-			if curr < len(ast.Params) && ast.Params[curr].Kind == "UnitNumberLiteral" {
-				exp, err := strconv.ParseFloat(ast.Params[curr].Value, 64)
+		exponentSign := float64(1)
+		// index of the first unit of the last factor, which can be a parenthesized group, -1 if there is none
+		lastFactor := -1
+		// whether a product or division is waiting for its second factor
+		expectFactor := false
 
+		for curr < len(ast.Params) {
+			token := ast.Params[curr]
+
+			if token.Kind == "FundamentalUnit" || token.Kind == "CustomUnit" {
+				lastFactor = len(cu.UnitsList)
+				cu.UnitsList = append(cu.UnitsList, UnitExponent{graph.namedUnit(token), exponentSign})
+				exponentSign, expectFactor = 1, false
+
+				curr++
+				continue
+			}
+
+			if token.Kind == "UnitParen" && token.Value == "(" {
+				curr++
+
+				group, err := parseGroup()
 				if err != nil {
 					return CompositeUnit{}, err
 				}
 
-				cu.UnitsList[len(cu.UnitsList)-1].Exponent = exp * exponentSign
+				if curr >= len(ast.Params) || group.IsEmpty() {
+					return CompositeUnit{}, fmt.Errorf("Failed to parse unit expression")
+				}
+
+				lastFactor = len(cu.UnitsList)
+				for _, factor := range group.UnitsList {
+					cu.UnitsList = append(cu.UnitsList, UnitExponent{factor.Unit, factor.Exponent * exponentSign})
+				}
+				exponentSign, expectFactor = 1, false
+
 				curr++
 				continue
-			} else {
-				return CompositeUnit{}, fmt.Errorf("Failed to parse unit expression")
 			}
+
+			if token.Kind == "UnitParen" && token.Value == ")" {
+				break
+			}
+
+			// a division or product must be between two factors
+			if (token.Kind == "UnitDivision" || token.Kind == "UnitProduct") && lastFactor >= 0 && !expectFactor {
+				if token.Kind == "UnitDivision" {
+					exponentSign = -1
+				}
+				expectFactor = true
+
+				curr++
+				continue
+			}
+
+			if token.Kind == "UnitExponent" && lastFactor >= 0 && !expectFactor {
+				curr++
+
+				if curr < len(ast.Params) && ast.Params[curr].Kind == "UnitNumberLiteral" {
+					exp, err := strconv.ParseFloat(ast.Params[curr].Value, 64)
+
+					if err != nil {
+						return CompositeUnit{}, err
+					}
+
+					for i := lastFactor; i < len(cu.UnitsList); i++ {
+						cu.UnitsList[i].Exponent *= exp
+					}
+					curr++
+
+					// a unit can be raised to a single exponent, e.g. m^2^3 is ambiguous
+					if curr < len(ast.Params) && ast.Params[curr].Kind == "UnitExponent" {
+						return CompositeUnit{}, fmt.Errorf("Invalid unit exponent chain")
+					}
+
+					continue
+				} else {
+					return CompositeUnit{}, fmt.Errorf("Failed to parse unit expression")
+				}
+			}
+
+			// a number can only stand for the numerator, e.g. 1/s
+			if token.Kind == "UnitNumberLiteral" && len(cu.UnitsList) == 0 && lastFactor < 0 {
+				lastFactor = 0
+				curr++
+				continue
+			}
+
+			return CompositeUnit{}, fmt.Errorf("Failed to parse unit expression")
 		}
 
-		if token.Kind == "UnitNumberLiteral" && len(cu.UnitsList) == 0 {
-			curr++
-			continue
+		if expectFactor {
+			return CompositeUnit{}, fmt.Errorf("Failed to parse unit expression")
 		}
 
+		return cu, nil
+	}
+
+	cu, err := parseGroup()
+	if err != nil {
+		return CompositeUnit{}, err
+	}
+
+	// a closing parenthesis without the opening one
+	if curr < len(ast.Params) {
 		return CompositeUnit{}, fmt.Errorf("Failed to parse unit expression")
 	}
 
 	return cu, nil
 }
 
+// Returns the unit a FundamentalUnit or CustomUnit node refers to, units that are not declared are new base units
+func (graph *ExecutionGraph) namedUnit(token Ast) FundamentalUnit {
+	if token.Kind == "FundamentalUnit" {
+		return graph.fundamentalUnit(token.Value)
+	}
+
+	if unit, ok := graph.Units[token.Value]; ok {
+		return unit
+	}
+
+	return FundamentalUnit{
+		ID:               token.Value,
+		DisplayValue:     token.Value,
+		Aliases:          []string{token.Value},
+		BaseUnit:         token.Value,
+		ConversionFactor: 1,
+		ConversionShift:  0,
+	}
+}
+
+// Groups each minus following another operator with its operand, e.g. 2 * -3 as 2 * (0 - 3), since parseOperator
+// handles the negation only at the start of an expression
+func groupUnaryMinus(ast *Ast) {
+	for i := range ast.Params {
+		groupUnaryMinus(&ast.Params[i])
+	}
+
+	if ast.Kind != "Expression" {
+		return
+	}
+
+	params := []Ast{}
+	for i := 0; i < len(ast.Params); i++ {
+		param := ast.Params[i]
+
+		// the factorial is a postfix operator, so a minus following it is a subtraction, e.g. 3! - 2
+		unary := param.Kind == "RawOperator" && param.Value == "-" && len(params) > 0 &&
+			params[len(params)-1].Kind == "RawOperator" && params[len(params)-1].Value != "!"
+
+		if end := unaryOperandEnd(ast.Params, i+1); unary && end > 0 {
+			group := Ast{Kind: "Expression", Params: append([]Ast{{Kind: "NumberLiteral", Value: "0"}}, ast.Params[i:end]...)}
+			groupUnaryMinus(&group)
+
+			params = append(params, group)
+			i = end - 1
+			continue
+		}
+
+		params = append(params, param)
+	}
+
+	ast.Params = params
+}
+
+// Returns the index following the operand of a negation starting at i, including the ^ and ! operators applied
+// to it, which bind more tightly than the negation, e.g. -2^2 is -(2^2), or -1 if the operand is missing
+func unaryOperandEnd(params []Ast, i int) int {
+	// the operand can be negated again, e.g. 2 * --3
+	for i < len(params) && params[i].Kind == "RawOperator" && params[i].Value == "-" {
+		i++
+	}
+	if i >= len(params) || params[i].Kind == "RawOperator" {
+		return -1
+	}
+	i++
+
+	for i < len(params) && params[i].Kind == "RawOperator" {
+		switch params[i].Value {
+		case "!":
+			i++
+		case "^":
+			if i = unaryOperandEnd(params, i+1); i < 0 {
+				return -1
+			}
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
 func parseOperator(ast *Ast, operator string) (*Ast, error) {
-	if ast.Kind == "NumberLiteral" || ast.Kind == "Constant" || ast.Kind == "Variable" {
+	if ast.Kind == "NumberLiteral" || ast.Kind == "Constant" || ast.Kind == "Variable" || ast.Kind == "PreviousResult" || ast.Kind == "LineReference" || ast.Kind == "Aggregate" || ast.Kind == "String" {
 		return ast, nil
 	}
 
@@ -664,30 +1817,38 @@ func parseOperator(ast *Ast, operator string) (*Ast, error) {
 			return nil, fmt.Errorf("Function called without argument")
 		}
 
-		if ast.Params[0].Kind == "RawOperator" {
-			return nil, fmt.Errorf("Cannot pass operation as argument to function")
-		}
+		parsedParams := []Ast{}
 
-		content, err := parseOperator(&ast.Params[0], operator)
-		if err != nil {
-			return nil, err
+		for i := range ast.Params {
+			if ast.Params[i].Kind == "RawOperator" {
+				return nil, fmt.Errorf("Cannot pass operation as argument to function")
+			}
+
+			content, err := parseOperator(&ast.Params[i], operator)
+			if err != nil {
+				return nil, err
+			}
+
+			parsedParams = append(parsedParams, *content)
 		}
 
-		ast.Params = []Ast{*content}
+		ast.Params = parsedParams
 
 		return ast, nil
 	}
 	if ast.Kind == "Operator" {
-		firstParam, err1 := parseOperator(&ast.Params[0], operator)
-		secondParam, err2 := parseOperator(&ast.Params[1], operator)
+		parsedParams := []Ast{}
+
+		for i := range ast.Params {
+			param, err := parseOperator(&ast.Params[i], operator)
+			if err != nil {
+				return nil, err
+			}
 
-		if err1 != nil {
-			return nil, err1
-		} else if err2 != nil {
-			return nil, err2
+			parsedParams = append(parsedParams, *param)
 		}
 
-		ast.Params = []Ast{*firstParam, *secondParam}
+		ast.Params = parsedParams
 
 		return ast, nil
 	}
@@ -712,75 +1873,415 @@ func parseOperator(ast *Ast, operator string) (*Ast, error) {
 					continue
 				}
 
-				// operators cannot end an expression
-				if i >= len(ast.Params)-1 {
-					return nil, fmt.Errorf("Cannot end expression with operation")
-				}
+				// the factorial is a postfix operator applied to the preceding operand only
+				if operator == "!" {
+					if len(parsedParams) == 0 || parsedParams[len(parsedParams)-1].Kind == "RawOperator" {
+						return nil, fmt.Errorf("Factorial must follow a number")
+					}
+
+					operand := parsedParams[len(parsedParams)-1]
+					parsedParams[len(parsedParams)-1] = Ast{Kind: "Operator", Value: "!", Params: []Ast{operand}}
+					continue
+				}
+
+				// operators cannot end an expression
+				if i >= len(ast.Params)-1 {
+					return nil, fmt.Errorf("Cannot end expression with operation")
+				}
+
+				// only - operator can start an expression
+				if len(parsedParams) == 0 && operator != "-" {
+					return nil, fmt.Errorf("Cannot start expression with operation")
+				}
+
+				newAst := Ast{Kind: "Operator", Value: token.Value}
+
+				var firstToken Ast
+				// -expression is parsed as 0-expression
+				if len(parsedParams) == 0 {
+					firstToken = Ast{Kind: "NumberLiteral", Value: "0"}
+				} else {
+					firstToken = parsedParams[len(parsedParams)-1]
+					parsedParams = parsedParams[:len(parsedParams)-1]
+				}
+
+				i++
+				token = ast.Params[i]
+				if token.Kind == "RawOperator" {
+					return nil, fmt.Errorf("Cannot have 2 operations consecutively")
+				}
+
+				secondToken, err := parseOperator(&token, operator)
+				if err != nil {
+					return nil, err
+				}
+
+				newAst.Params = []Ast{firstToken, *secondToken}
+				parsedParams = append(parsedParams, newAst)
+			}
+		}
+
+		ast.Params = parsedParams
+		return ast, nil
+	}
+
+	if ast.Kind == "Method" {
+		return ast, nil
+	}
+
+	panic("Unrecognized AST")
+}
+
+// Number of arguments accepted by each function, functions not listed take a single argument
+var functionArgumentsCount = map[string][]int{
+	"clamp":         {3},
+	"hypot":         {2},
+	"ncr":           {2},
+	"npr":           {2},
+	"round":         {1, 2},
+	"percentchange": {2},
+}
+
+// Computes the factorial of a number with no unit, failing if it's not a non-negative integer
+func factorialOf(value float64, unit CompositeUnit) (float64, error) {
+	if !unit.IsEmpty() {
+		return 0, fmt.Errorf("Factorial must be applied to a number with no unit")
+	}
+	if value < 0 || value != math.Trunc(value) {
+		return 0, fmt.Errorf("Factorial must be applied to a non-negative integer")
+	}
+
+	// 171! overflows float64, checking it first avoids multiplying up to huge numbers one factor at a time
+	if value > 170 {
+		return math.Inf(1), nil
+	}
+
+	return permutations(value, value), nil
+}
+
+// Execute computes the value of each line in the file
+func (graph *ExecutionGraph) Execute() {
+	for _, line := range graph.ExecutionOrder {
+		graph.executeLine(line)
+	}
+}
+
+// ExecuteContext computes the value of each line in the file like Execute, stopping as soon as the context is done
+// and returning its error. The line being executed fails with the error of the context, while the following ones
+// keep their previous results
+func (graph *ExecutionGraph) ExecuteContext(ctx context.Context) error {
+	graph.ctx = ctx
+	defer func() { graph.ctx = nil }()
+
+	for _, line := range graph.ExecutionOrder {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		graph.executeLine(line)
+	}
+
+	return ctx.Err()
+}
+
+// Computes the value of a line, whose dependencies must have already been executed
+func (graph *ExecutionGraph) executeLine(line int) {
+	// the errors of a previous execution are cleared, while syntax errors are kept
+	if graph.Lines[line].executionFailed {
+		graph.Lines[line].Error = nil
+		graph.Lines[line].executionFailed = false
+	}
+
+	if !graph.Lines[line].IsEmpty() && !graph.Lines[line].HasError() {
+		// the units are checked before computing any value, e.g. 1/0 + (3 [s]) fails for the units
+		// instead of the division by zero, the lines whose unit depends on the values are checked by executeAst
+		if _, err := unitOf(&graph.Lines[line].Ast, graph, nil); err != nil && err != errUnknownUnit {
+			graph.Lines[line].Error = err
+			graph.Lines[line].executionFailed = true
+			return
+		}
+
+		val, unit, err := executeAst(&graph.Lines[line].Ast, graph)
+
+		if err == nil && math.IsNaN(val) {
+			err = fmt.Errorf("The result is not a real number")
+		} else if err == nil && math.IsInf(val, 0) && !graph.AllowInfinity {
+			err = fmt.Errorf("The result is infinite")
+		}
+
+		// units written at the end of the line, e.g. `5 [N m]` for a torque, are not simplified,
+		// while only the ones the line converts to explicitly, e.g. `x [km]`, are not scaled
+		if err == nil && graph.SimplifyUnits && !graph.Lines[line].hasWrittenUnit() {
+			val, unit = SimplifyCompositeUnit(val, unit)
+		}
+		if err == nil && graph.ScalePrefixes && !graph.Lines[line].hasExplicitConversion() {
+			val, unit = ScaleSIPrefix(val, unit)
+		}
+
+		if err != nil {
+			graph.Lines[line].Error = err
+			graph.Lines[line].executionFailed = true
+		} else {
+			graph.Lines[line].Value = val
+			graph.Lines[line].Unit = unit
+		}
+	}
+}
+
+// AppendLine parses and executes a new line of code at the end of an executed graph, returning its statements.
+// The line can only refer to the lines above it, so redefining a variable affects only the following lines,
+// e.g. `a: a + 1` increments a
+func (graph *ExecutionGraph) AppendLine(source string) []*Line {
+	if graph.Variables == nil {
+		graph.Variables = map[string]int{}
+	}
+	if graph.Units == nil {
+		graph.Units = map[string]FundamentalUnit{}
+	}
+
+	sourceLine := 0
+	if len(graph.Lines) > 0 {
+		sourceLine = graph.Lines[len(graph.Lines)-1].SourceLine + 1
+		graph.SourceCode += "\n"
+	}
+	graph.SourceCode += source
+
+	first := len(graph.Lines)
+	tokens, err := tokenizer(source, false)
+
+	if err != nil {
+		graph.Lines = append(graph.Lines, Line{SourceLine: sourceLine, Error: graph.locateError(err, sourceLine, source)})
+		graph.Dependents = append(graph.Dependents, nil)
+	} else {
+		for _, statement := range splitStatements(tokens) {
+			graph.Lines = append(graph.Lines, Line{SourceLine: sourceLine, Tokens: removeNonSemanticTokens(statement), RawTokens: statement})
+			graph.Dependents = append(graph.Dependents, nil)
+			graph.appendStatement(len(graph.Lines)-1, source)
+		}
+	}
+
+	lines := []*Line{}
+	for i := first; i < len(graph.Lines); i++ {
+		lines = append(lines, &graph.Lines[i])
+	}
+
+	return lines
+}
+
+// Parses and executes the statement at the end of an executed graph
+func (graph *ExecutionGraph) appendStatement(i int, source string) {
+	line := &graph.Lines[i]
+
+	graph.parseUnitDeclaration(i, source)
+	isDeclaration := parseVariableDeclaration(line)
+
+	if !line.HasError() {
+		ast, err := parser(line.Tokens, graph)
+
+		if err != nil {
+			line.Error = graph.locateError(err, line.SourceLine, source)
+		} else {
+			line.Ast = ast
+			line.Error = graph.resolveReferences(&line.Ast, i)
+		}
+	}
+
+	graph.ExecutionOrder = append(graph.ExecutionOrder, i)
+	graph.executeLine(i)
+
+	// the variable is registered after the execution, so that the definition refers to the previous value
+	if isDeclaration {
+		graph.Variables[line.Name] = i
+	}
+}
+
+// UpdateLine replaces a line of code of a graph created by ParseCode and executed, then recomputes only its statements
+// and the lines depending on them, directly or transitively, keeping the values of the other lines.
+// It returns the recomputed statements in execution order. Changes to the declarations, e.g. renaming a variable,
+// or to which lines ans can refer to, e.g. emptying a line, cause the whole code to be parsed and executed again
+func (graph *ExecutionGraph) UpdateLine(sourceLine int, source string) ([]int, error) {
+	sourceLines := strings.Split(graph.SourceCode, "\n")
+	if sourceLine < 0 || sourceLine >= len(sourceLines) {
+		return nil, fmt.Errorf("Line %d does not exist", sourceLine+1)
+	}
+
+	sourceLines[sourceLine] = source
+	graph.SourceCode = strings.Join(sourceLines, "\n")
+
+	statements := []int{}
+	for i := range graph.Lines {
+		if graph.Lines[i].SourceLine == sourceLine {
+			statements = append(statements, i)
+		}
+	}
+
+	updated := []Line{}
+	tokens, err := tokenizer(source, false)
+
+	if err != nil {
+		updated = append(updated, Line{SourceLine: sourceLine, Error: graph.locateError(err, sourceLine, source)})
+	} else {
+		for _, statement := range splitStatements(tokens) {
+			updated = append(updated, Line{SourceLine: sourceLine, Tokens: removeNonSemanticTokens(statement), RawTokens: statement})
+		}
+	}
+
+	if len(updated) != len(statements) {
+		return graph.reexecute()
+	}
+
+	for i, line := range statements {
+		old := &graph.Lines[line]
+		replacement := &updated[i]
+
+		if isUnitDeclaration(removeNonSemanticTokens(old.RawTokens)) || isUnitDeclaration(replacement.Tokens) {
+			return graph.reexecute()
+		}
+
+		if !replacement.HasError() {
+			parseVariableDeclaration(replacement)
+
+			ast, err := parser(replacement.Tokens, graph)
+			if err != nil {
+				replacement.Error = graph.locateError(err, sourceLine, source)
+			} else {
+				replacement.Ast = ast
+			}
+		}
+
+		if replacement.Name != old.Name {
+			return graph.reexecute()
+		}
+	}
+
+	for i, line := range statements {
+		for _, dependency := range graph.Lines[line].Dependencies {
+			graph.Dependents[dependency] = removeInt(graph.Dependents[dependency], line)
+		}
+
+		hadResult := !graph.Lines[line].IsEmpty() && (!graph.Lines[line].HasError() || graph.Lines[line].executionFailed)
+		graph.Lines[line] = updated[i]
+
+		if !graph.Lines[line].HasError() {
+			graph.Lines[line].Error = graph.resolveReferences(&graph.Lines[line].Ast, line)
+		}
+
+		// ans in the following lines could now refer to a different line
+		if hasResult := !graph.Lines[line].IsEmpty() && !graph.Lines[line].HasError(); hasResult != hadResult {
+			return graph.reexecute()
+		}
+	}
+
+	if cycle := graph.findCyclicalDependencies(); cycle != nil {
+		return graph.reexecute()
+	}
+
+	graph.findExecutionOrder()
+
+	return graph.executeDependents(statements), nil
+}
+
+// UpdateSource replaces the SourceCode of a graph created by ParseCode and executed. When the number of lines
+// is unchanged, only the changed lines are updated as UpdateLine does, otherwise the whole code is parsed
+// and executed again
+func (graph *ExecutionGraph) UpdateSource(sourceCode string) error {
+	oldLines := strings.Split(graph.SourceCode, "\n")
+	newLines := strings.Split(sourceCode, "\n")
+
+	if len(oldLines) != len(newLines) {
+		graph.SourceCode = sourceCode
+		_, err := graph.reexecute()
 
-				// only - operator can start an expression
-				if len(parsedParams) == 0 && operator != "-" {
-					return nil, fmt.Errorf("Cannot start expression with operation")
-				}
+		return err
+	}
 
-				newAst := Ast{Kind: "Operator", Value: token.Value}
+	for i := range newLines {
+		if newLines[i] == oldLines[i] {
+			continue
+		}
 
-				var firstToken Ast
-				// -expression is parsed as 0-expression
-				if len(parsedParams) == 0 {
-					firstToken = Ast{Kind: "NumberLiteral", Value: "0"}
-				} else {
-					firstToken = parsedParams[len(parsedParams)-1]
-					parsedParams = parsedParams[:len(parsedParams)-1]
-				}
+		if _, err := graph.UpdateLine(i, newLines[i]); err != nil {
+			return err
+		}
+	}
 
-				i++
-				token = ast.Params[i]
-				if token.Kind == "RawOperator" {
-					return nil, fmt.Errorf("Cannot have 2 operations consecutively")
-				}
+	return nil
+}
 
-				secondToken, err := parseOperator(&token, operator)
-				if err != nil {
-					return nil, err
-				}
+// Executes again the given lines and the lines depending on them, directly or transitively,
+// returning the executed lines in execution order
+func (graph *ExecutionGraph) executeDependents(lines []int) []int {
+	// visits the reverse dependencies to find the lines affected by the change
+	affected := make([]bool, len(graph.Lines))
+	stack := append([]int{}, lines...)
 
-				newAst.Params = []Ast{firstToken, *secondToken}
-				parsedParams = append(parsedParams, newAst)
-			}
+	for len(stack) > 0 {
+		line := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if affected[line] {
+			continue
 		}
 
-		ast.Params = parsedParams
-		return ast, nil
+		affected[line] = true
+		stack = append(stack, graph.Dependents[line]...)
 	}
 
-	if ast.Kind == "Method" {
-		return ast, nil
+	executed := []int{}
+	for _, line := range graph.ExecutionOrder {
+		if affected[line] {
+			graph.executeLine(line)
+			executed = append(executed, line)
+		}
 	}
 
-	panic("Unrecognized AST")
+	return executed
 }
 
-// Execute computes the value of each line in the file
-func (graph *ExecutionGraph) Execute() {
-	for _, line := range graph.ExecutionOrder {
-		if !graph.Lines[line].IsEmpty() && !graph.Lines[line].HasError() {
-			val, unit, err := executeAst(&graph.Lines[line].Ast, graph)
+// Parses and executes again the whole SourceCode, returning the execution order
+func (graph *ExecutionGraph) reexecute() ([]int, error) {
+	graph.Lines = nil
 
-			if err != nil {
-				graph.Lines[line].Error = err
-			} else {
-				graph.Lines[line].Value = val
-				graph.Lines[line].Unit = unit
-			}
-		}
+	if err := graph.Parse(); err != nil {
+		return nil, err
 	}
+
+	graph.Execute()
+
+	return graph.ExecutionOrder, nil
 }
 
 func executeAst(ast *Ast, graph *ExecutionGraph) (float64, CompositeUnit, error) {
+	// checked again at execution for the calls the parser adds, e.g. abs for the absolute value bars
+	if err := graph.checkFunctionAllowed(ast); err != nil {
+		return 0, CompositeUnit{}, err
+	}
+
 	if ast.Kind == "NumberLiteral" {
+		// hexadecimal and binary literals are integers, so they skip the decimal separators handling
+		if len(ast.Value) > 2 && ast.Value[0] == '0' && strings.ContainsAny(ast.Value[1:2], "xXbB") {
+			base := 16
+			if ast.Value[1] == 'b' || ast.Value[1] == 'B' {
+				base = 2
+			}
+
+			val, err := strconv.ParseInt(ast.Value[2:], base, 64)
+
+			if err != nil {
+				return 0, CompositeUnit{}, fmt.Errorf("Invalid number literal")
+			}
+
+			return float64(val), CompositeUnit{}, nil
+		}
+
+		thousandsSeparator, decimalSeparator := graph.separators()
+		if !hasValidGrouping(ast.Value, thousandsSeparator, decimalSeparator) {
+			return 0, CompositeUnit{}, fmt.Errorf("Invalid number literal, '%s' separates the thousands in groups of 3 digits, the decimals follow '%s'", thousandsSeparator, decimalSeparator)
+		}
+
 		raw := ast.Value
-		raw = strings.ReplaceAll(raw, ".", "")
-		raw = strings.ReplaceAll(raw, ",", ".")
+		raw = strings.ReplaceAll(raw, thousandsSeparator, "")
+		raw = strings.ReplaceAll(raw, decimalSeparator, ".")
 
 		isPercentage := false
 		if raw[len(raw)-1] == '%' {
@@ -801,150 +2302,280 @@ func executeAst(ast *Ast, graph *ExecutionGraph) (float64, CompositeUnit, error)
 		return val, CompositeUnit{}, nil
 	}
 
-	if ast.Kind == "Variable" {
-		line, _ := graph.Variables[ast.Value]
-
-		if graph.Lines[line].IsEmpty() {
-			return 0, CompositeUnit{}, fmt.Errorf("Referring to a variable defined by empty expression")
-		} else if graph.Lines[line].HasError() {
-			return 0, CompositeUnit{}, fmt.Errorf("Referring to a variable whose definition has an error")
+	if ast.Kind == "Variable" || ast.Kind == "PreviousResult" || ast.Kind == "LineReference" {
+		line, err := graph.referredLine(ast)
+		if err != nil {
+			return 0, CompositeUnit{}, err
 		}
 
 		return graph.Lines[line].Value, graph.Lines[line].Unit, nil
 	}
 
-	if ast.Kind == "Expression" {
-		if len(ast.Params) == 0 {
-			panic("Cannot evaluate empty expression")
+	// the lines of the range are added in the unit of the first one, empty lines are skipped
+	if ast.Kind == "Aggregate" {
+		total, totalUnit, count := float64(0), CompositeUnit{}, 0
+
+		for _, reference := range ast.Params {
+			// a range can span the whole file, so the execution can be interrupted while adding it up
+			if err := graph.interrupted(); err != nil {
+				return 0, CompositeUnit{}, err
+			}
+
+			line, _ := strconv.Atoi(reference.Value)
+
+			if graph.Lines[line].IsEmpty() {
+				continue
+			}
+
+			value, unit, err := executeAst(&reference, graph)
+			if err != nil {
+				return 0, CompositeUnit{}, err
+			}
+
+			if totalUnit, err = aggregatedUnit(ast.Value, totalUnit, unit, count, graph.Lines[line]); err != nil {
+				return 0, CompositeUnit{}, err
+			}
+
+			converted, err := ConvertCompositeUnits(value, unit, totalUnit)
+			if err != nil {
+				return 0, CompositeUnit{}, fmt.Errorf("Cannot add line %d to the %s: %s", graph.Lines[line].SourceLine+1, ast.Value, err)
+			}
+
+			total += converted
+			count++
+		}
+
+		unit, err := aggregateUnit(ast.Value, totalUnit, count)
+		if err != nil {
+			return 0, CompositeUnit{}, err
+		}
+
+		if ast.Value == "avg" {
+			return total / float64(count), unit, nil
 		}
 
-		val, unit, err := executeAst(&ast.Params[0], graph)
+		return total, unit, nil
+	}
+
+	if ast.Kind == "Expression" || ast.Kind == "Conversion" {
+		operand, err := expressionOperand(ast)
+		if err != nil {
+			return 0, CompositeUnit{}, err
+		}
 
+		val, unit, err := executeAst(operand, graph)
 		if err != nil {
-			return val, unit, err
+			return 0, CompositeUnit{}, err
 		}
 
-		if ast.Unit.IsEmpty() {
-			return val, unit, nil
+		var target CompositeUnit
+		if ast.Kind == "Conversion" {
+			target, err = conversionUnit(unit, ast.Unit)
+		} else {
+			target, err = expressionUnit(ast, unit)
+		}
+		if err != nil {
+			return 0, CompositeUnit{}, err
 		}
 
+		// numbers with no unit take the unit as it is
 		if unit.IsEmpty() {
-			return val, ast.Unit, nil
+			return val, target, nil
 		}
 
-		val, err = ConvertCompositeUnits(val, unit, ast.Unit)
-		return val, ast.Unit, err
+		// the units are compatible, but the reciprocal units cannot convert 0, e.g. 0 [mpg]
+		val, err = ConvertCompositeUnitsExplicitly(val, unit, target)
+		return val, target, err
 	}
 
 	if ast.Kind == "Operator" {
-		firstValue, unit1, err1 := executeAst(&ast.Params[0], graph)
-		secondValue, unit2, err2 := executeAst(&ast.Params[1], graph)
-
-		if err1 != nil {
-			return 0, CompositeUnit{}, err1
-		} else if err2 != nil {
-			return 0, CompositeUnit{}, err2
+		firstValue, unit1, err := executeAst(&ast.Params[0], graph)
+		if err != nil {
+			return 0, CompositeUnit{}, err
 		}
 
-		switch ast.Value {
-		case "+":
-			secondValueConverted, err := ConvertCompositeUnits(secondValue, unit2, unit1)
-			if err != nil {
+		if ast.Value == "!" {
+			if _, err := operatorUnit(ast.Value, unit1, CompositeUnit{}, 0); err != nil {
 				return 0, CompositeUnit{}, err
 			}
 
-			return firstValue + secondValueConverted, unit1, nil
-		case "-":
-			secondValueConverted, err := ConvertCompositeUnits(secondValue, unit2, unit1)
-			if err != nil {
-				return 0, CompositeUnit{}, err
-			}
+			value, err := factorialOf(firstValue, unit1)
+			return value, CompositeUnit{}, err
+		}
+
+		secondValue, unit2, err := executeAst(&ast.Params[1], graph)
+		if err != nil {
+			return 0, CompositeUnit{}, err
+		}
+
+		unit, err := operatorUnit(ast.Value, unit1, unit2, secondValue)
+		if err != nil {
+			return 0, CompositeUnit{}, err
+		}
 
-			return firstValue - secondValueConverted, unit1, nil
+		switch ast.Value {
+		case "+":
+			secondValueConverted, err := ConvertCompositeUnitsInterval(secondValue, unit2, unit1)
+			return firstValue + secondValueConverted, unit, err
+		case "-":
+			secondValueConverted, err := ConvertCompositeUnitsInterval(secondValue, unit2, unit1)
+			return firstValue - secondValueConverted, unit, err
 		case "*":
-			val, unit := CompositeUnitProduct(firstValue, secondValue, unit1, unit2)
+			val, _ := CompositeUnitProduct(firstValue, secondValue, unit1, unit2)
 			return val, unit, nil
 		case "/":
-			val, unit := CompositeUnitDivision(firstValue, secondValue, unit1, unit2)
-			return val, unit, nil
-		case "^":
-			if !unit2.IsEmpty() {
-				return 0, CompositeUnit{}, fmt.Errorf("Exponent must be a number with no unit")
+			if secondValue == 0 && !graph.AllowInfinity {
+				return 0, CompositeUnit{}, fmt.Errorf("Division by zero")
 			}
 
-			return math.Pow(firstValue, secondValue), CompositeUnitExponentiation(unit1, secondValue), nil
-		default:
-			panic("Unknown operation")
+			val, _ := CompositeUnitDivision(firstValue, secondValue, unit1, unit2)
+			return val, unit, nil
 		}
+
+		return math.Pow(firstValue, secondValue), unit, nil
 	}
 
 	if ast.Kind == "Function" {
-		value, unit, err := executeAst(&ast.Params[0], graph)
+		args := []float64{}
+		units := []CompositeUnit{}
+
+		for i := range ast.Params {
+			value, unit, err := executeAst(&ast.Params[i], graph)
+
+			if err != nil {
+				return 0, CompositeUnit{}, err
+			}
+
+			args = append(args, value)
+			units = append(units, unit)
+		}
 
+		// the units of the arguments are checked by functionUnit, so the conversions below fail only for the values
+		resultUnit, err := functionUnit(ast.Value, units)
 		if err != nil {
 			return 0, CompositeUnit{}, err
 		}
 
+		value, unit := args[0], units[0]
+
 		switch ast.Value {
-		case "sqrt":
-			return math.Sqrt(value), CompositeUnitExponentiation(unit, 0.5), nil
-		case "log":
-			return math.Log10(value), unit, nil
-		case "ln":
-			return math.Log(value), unit, nil
-		case "sin":
-			if unit.String() == "rad" {
-				return math.Sin(value), CompositeUnit{}, nil
+		case "clamp":
+			lo, err := ConvertCompositeUnits(args[1], units[1], unit)
+			if err != nil {
+				return 0, CompositeUnit{}, err
+			}
+
+			hi, err := ConvertCompositeUnits(args[2], units[2], unit)
+			if err != nil {
+				return 0, CompositeUnit{}, err
+			}
+
+			if lo > hi {
+				return 0, CompositeUnit{}, fmt.Errorf("The lower bound of clamp is greater than the upper bound")
 			}
-			if unit.String() == "deg" {
-				value = ConvertFundamentalUnits(value, UnitTable["degrees"], UnitTable["radians"], 1)
 
-				return math.Sin(value), CompositeUnit{}, nil
+			return math.Min(math.Max(value, lo), hi), resultUnit, nil
+		case "hypot":
+			other, err := ConvertCompositeUnits(args[1], units[1], unit)
+			return math.Hypot(value, other), resultUnit, err
+		case "percentchange":
+			final, err := ConvertCompositeUnits(args[1], units[1], unit)
+			if err != nil {
+				return 0, CompositeUnit{}, err
+			}
+			if value == 0 && !graph.AllowInfinity {
+				return 0, CompositeUnit{}, fmt.Errorf("Division by zero")
+			}
+
+			return (final - value) / value, resultUnit, nil
+		case "factorial":
+			value, err := factorialOf(value, unit)
+			return value, resultUnit, err
+		case "ncr", "npr":
+			n, k := args[0], args[1]
+
+			if n < 0 || k < 0 || n != math.Trunc(n) || k != math.Trunc(k) {
+				return 0, CompositeUnit{}, fmt.Errorf("Arguments of %s must be non-negative integers", ast.Value)
+			}
+			if k > n {
+				return 0, CompositeUnit{}, fmt.Errorf("The second argument of %s cannot be greater than the first", ast.Value)
 			}
 
-			return math.Sin(value), unit, nil
-		case "cos":
-			if unit.String() == "rad" {
-				return math.Cos(value), CompositeUnit{}, nil
+			if ast.Value == "ncr" {
+				return combinations(n, k), resultUnit, nil
 			}
-			if unit.String() == "deg" {
-				value = ConvertFundamentalUnits(value, UnitTable["degrees"], UnitTable["radians"], 1)
-				return math.Cos(value), CompositeUnit{}, nil
+			return permutations(n, k), resultUnit, nil
+		case "sqrt":
+			return math.Sqrt(value), resultUnit, nil
+		case "log":
+			return math.Log10(value), resultUnit, nil
+		case "ln":
+			return math.Log(value), resultUnit, nil
+		case "sin", "cos", "tan":
+			// angles are converted to radians, functionUnit rejects the other units
+			if !unit.IsEmpty() {
+				value, _ = ConvertCompositeUnits(value, unit, radiansUnit)
 			}
 
-			return math.Cos(value), unit, nil
-		case "tan":
-			if unit.String() == "rad" {
-				return math.Tan(value), CompositeUnit{}, nil
+			switch ast.Value {
+			case "sin":
+				return math.Sin(value), resultUnit, nil
+			case "cos":
+				return math.Cos(value), resultUnit, nil
 			}
-			if unit.String() == "deg" {
-				value = ConvertFundamentalUnits(value, UnitTable["degrees"], UnitTable["radians"], 1)
-				return math.Tan(value), CompositeUnit{}, nil
+
+			return math.Tan(value), resultUnit, nil
+		case "degrees", "radians":
+			// numbers with no unit are assumed to be expressed in the other angle unit
+			if unit.IsEmpty() {
+				from := UnitTable["radians"]
+				if ast.Value == "radians" {
+					from = UnitTable["degrees"]
+				}
+
+				return ConvertFundamentalUnits(value, from, UnitTable[ast.Value], 1), resultUnit, nil
 			}
 
-			return math.Tan(value), unit, nil
+			converted, err := ConvertCompositeUnits(value, unit, resultUnit)
+			return converted, resultUnit, err
 		case "abs":
-			return math.Abs(value), unit, nil
+			return math.Abs(value), resultUnit, nil
 		case "round":
-			return math.Round(value), unit, nil
+			if len(args) == 1 {
+				return math.Round(value), resultUnit, nil
+			}
+
+			decimals := args[1]
+			if decimals < 0 || decimals != math.Trunc(decimals) {
+				return 0, CompositeUnit{}, fmt.Errorf("The decimal places of round must be a non-negative integer")
+			}
+
+			return roundToDecimal(value, int(decimals)), resultUnit, nil
 		case "ceil":
-			return math.Ceil(value), unit, nil
+			return math.Ceil(value), resultUnit, nil
 		case "floor":
-			return math.Floor(value), unit, nil
-		default:
-			panic("Unknown function")
+			return math.Floor(value), resultUnit, nil
+		case "trunc":
+			return math.Trunc(value), resultUnit, nil
+		case "frac":
+			return value - math.Trunc(value), resultUnit, nil
 		}
+
+		// breakdown keeps the value, it only changes how the result of the line is displayed
+		return value, resultUnit, nil
 	}
 
 	if ast.Kind == "Method" {
-		switch ast.Value {
-		case "ascii":
-			if len(ast.Params) == 0 || ast.Params[0].Kind != "String" {
-				return 0, CompositeUnit{}, fmt.Errorf("You must pass a string to the ascii method")
-			}
-
-			return float64(int(ast.Params[0].Value[0])), CompositeUnit{}, nil
+		unit, err := methodUnit(ast)
+		if err != nil {
+			return 0, CompositeUnit{}, err
 		}
+
+		return float64(int(ast.Params[0].Value[0])), unit, nil
+	}
+
+	if ast.Kind == "String" {
+		return 0, CompositeUnit{}, errStringOperand
 	}
 
 	if ast.Kind == "Constant" {
@@ -953,70 +2584,261 @@ func executeAst(ast *Ast, graph *ExecutionGraph) (float64, CompositeUnit, error)
 			return math.Pi, CompositeUnit{}, nil
 		case "e":
 			return math.E, CompositeUnit{}, nil
-		default:
-			panic("Unknown constant")
+		case "tau":
+			return 2 * math.Pi, CompositeUnit{}, nil
+		case "phi":
+			return (1 + math.Sqrt(5)) / 2, CompositeUnit{}, nil
 		}
+
+		if constant, ok := PhysicalConstants[ast.Value]; ok {
+			return constant.Value, constantUnit(ast.Value), nil
+		}
+
+		return 0, CompositeUnit{}, fmt.Errorf("Unknown constant %s", ast.Value)
 	}
 
-	panic("Unrecognized AST")
+	return 0, CompositeUnit{}, fmt.Errorf("Unrecognized expression %s", ast.Kind)
 }
 
-// ColorizedHTML returns the source code as HTML with CSS classes to tag the parsed semantic
+// ColorizedHTML returns the source code as HTML, with each line in a calc-line div whose data-line attribute is
+// its number, and CSS classes to tag the parsed semantic
+// and, in a parsed graph, the calc-line-error class to tag the lines with an error
+// and calc-token-error the token where a syntax error is located
 func (graph *ExecutionGraph) ColorizedHTML() string {
 	colorizedLines := []string{}
-	functions := []string{"sqrt", "log", "ln", "sin", "cos", "tan", "abs", "ln", "round", "ceil", "floor"}
-	constants := []string{"pi", "e"}
+	functions := append(append([]string{}, Functions...), Aggregates...)
+	constants := append([]string{"ans"}, Constants...)
+	// the variables with the same name override the physical constants
+	isPhysicalConstant := func(name string) bool {
+		_, constant := PhysicalConstants[name]
+		_, variable := graph.Variables[name]
+
+		return constant && !variable
+	}
+	sourceLines := strings.Split(graph.SourceCode, "\n")
 
 	for _, line := range graph.Lines {
 		colorizedLine := ""
 		insideUnitTag := ""
 
-		for _, token := range line.RawTokens {
+		// the statements on the same line of code are colorized together
+		if len(colorizedLines) <= line.SourceLine {
+			colorizedLines = append(colorizedLines, "")
+		}
+
+		// the lines that could not be tokenized are shown with their unknown characters
+		tokens := line.RawTokens
+		if len(tokens) == 0 && line.HasError() {
+			tokens, _ = tokenizer(sourceLines[line.SourceLine], true)
+		}
+
+		// the token containing the position of a syntax error is marked, if any
+		errorStart := -1
+		if syntaxError, ok := line.Error.(SyntaxError); ok {
+			errorStart = syntaxError.Column - 1
+		}
+
+		for _, token := range tokens {
 			if token.Kind == "bracket" && token.Value == "[" {
 				insideUnitTag = "-unit"
 			}
+			// a comment ends the statement, so a bracket left open before it does not extend to the comment
+			if token.Kind == "comment" {
+				insideUnitTag = ""
+			}
 
-			if token.Kind != "literal" {
-				colorizedLine += fmt.Sprintf(`<span class="calc-token-%s">%s</span>`, token.Kind+insideUnitTag, token.Value)
-			} else {
+			kind := token.Kind
+			if token.Kind == "literal" {
 				switch {
 				case containsString(functions, token.Value):
-					colorizedLine += fmt.Sprintf(`<span class="calc-token-%s">%s</span>`, "function"+insideUnitTag, token.Value)
+					kind = "function"
 				case containsString(constants, token.Value):
-					colorizedLine += fmt.Sprintf(`<span class="calc-token-%s">%s</span>`, "constant"+insideUnitTag, token.Value)
-				default:
-					colorizedLine += fmt.Sprintf(`<span class="calc-token-%s">%s</span>`, "literal"+insideUnitTag, token.Value)
+					kind = "constant"
+				case isPhysicalConstant(token.Value):
+					kind = "constant"
 				}
 			}
 
+			class := "calc-token-" + kind + insideUnitTag
+			if errorStart >= token.Start && errorStart < token.End {
+				class += " calc-token-error"
+			}
+
+			// the offsets map the token back to the characters of the source line
+			colorizedLine += fmt.Sprintf(`<span class="%s" data-start="%d" data-end="%d">%s</span>`, class, token.Start, token.End, html.EscapeString(token.Value))
+
 			if token.Kind == "bracket" && token.Value == "]" {
 				insideUnitTag = ""
 			}
 		}
 
-		colorizedLines = append(colorizedLines, colorizedLine)
+		if line.HasError() {
+			colorizedLine = `<span class="calc-line-error">` + colorizedLine + `</span>`
+		}
+
+		colorizedLines[line.SourceLine] += colorizedLine
+	}
+
+	// each line is wrapped in its own element, numbered from 1
+	result := ""
+	for i, colorizedLine := range colorizedLines {
+		result += fmt.Sprintf(`<div class="calc-line" data-line="%d">%s</div>`, i+1, colorizedLine)
 	}
 
-	return strings.Join(colorizedLines, "<br/>")
+	return result
 }
 
+// ExecutionResult returns the results of all the lines, one per line, as formatted by LineResult
 func (graph *ExecutionGraph) ExecutionResult() string {
-	result := ""
+	results := []string{}
+	for i := range graph.Lines {
+		result := graph.LineResult(&graph.Lines[i])
+
+		// the results of the statements on the same line of code are separated by semicolons
+		if i > 0 && graph.Lines[i].SourceLine == graph.Lines[i-1].SourceLine {
+			results[len(results)-1] += "; " + result
+		} else {
+			results = append(results, result)
+		}
+	}
+
+	return strings.Join(results, "\n")
+}
+
+// LineResult is the serializable result of the execution of a line
+type LineResult struct {
+	File  string   `json:"file,omitempty"` // file containing the line, if the graph has SourceFiles
+	Line  int      `json:"line"`           // line number, counting from 1
+	Name  string   `json:"name,omitempty"`
+	Empty bool     `json:"empty"`
+	Value *float64 `json:"value"` // nil for empty lines and errors
+	Unit  string   `json:"unit"`
+	Error string   `json:"error,omitempty"`
+
+	// the displayed result, if it is not the value followed by the unit, e.g. `1 day 1 hour` for breakdown
+	Text string `json:"text,omitempty"`
+
+	Column int `json:"column,omitempty"` // column of the error, if it is a syntax error
+}
+
+// ExecutionResultJSON returns the result of each line, empty lines included, in a form suitable for JSON serialization
+func (graph *ExecutionGraph) ExecutionResultJSON() []LineResult {
+	results := []LineResult{}
+
 	for i := range graph.Lines {
+		result := LineResult{Name: graph.Lines[i].Name}
+		result.File, result.Line = graph.sourcePosition(graph.Lines[i].SourceLine)
+
 		if graph.Lines[i].HasError() {
-			result += fmt.Sprintf("! %s\n", graph.Lines[i].Error)
+			result.Error = graph.Lines[i].Error.Error()
+
+			if syntaxError, ok := graph.Lines[i].Error.(SyntaxError); ok {
+				result.Column = syntaxError.Column
+			}
 		} else if graph.Lines[i].IsEmpty() {
-			result += "X\n"
+			result.Empty = true
+		} else if math.IsNaN(graph.Lines[i].Value) || math.IsInf(graph.Lines[i].Value, 0) {
+			// JSON cannot represent non finite numbers
+			result.Error = fmt.Sprintf("The result %f is not a finite number", graph.Lines[i].Value)
 		} else {
-			unitString := graph.Lines[i].Unit.String()
+			// the value is kept at full precision, the rounding is only for the displayed results
+			value := graph.Lines[i].Value
+			result.Value = &value
+			result.Unit = graph.Lines[i].Unit.String()
 
-			if unitString != "" {
-				unitString = " " + unitString
+			if graph.Lines[i].isBreakdown() {
+				result.Text = graph.formatBreakdown(graph.Lines[i].Value, graph.Lines[i].Unit)
 			}
+		}
+
+		results = append(results, result)
+	}
 
-			result += fmt.Sprintf("%f%s\n", roundToDecimal(graph.Lines[i].Value, 13), unitString)
+	return results
+}
+
+// ExpressionResult is the serializable result of a source made of a single expression
+type ExpressionResult struct {
+	Value *float64 `json:"value"` // nil if the expression has an error
+	Unit  *string  `json:"unit"`
+	Error *string  `json:"error"` // nil if the expression was evaluated
+}
+
+// ExpressionResultJSON returns the result of the only line of the graph, in a form suitable for JSON serialization,
+// or an error if the source is empty or has more than one line
+func (graph *ExecutionGraph) ExpressionResultJSON() ExpressionResult {
+	results := graph.ExecutionResultJSON()
+	message := ""
+
+	if len(results) != 1 {
+		message = "The expression must be a single line"
+	} else if results[0].Empty {
+		message = "The expression is empty"
+	} else if results[0].Error != "" {
+		message = results[0].Error
+	}
+
+	if message != "" {
+		return ExpressionResult{Error: &message}
+	}
+
+	return ExpressionResult{Value: results[0].Value, Unit: &results[0].Unit}
+}
+
+// LineTokens is the serializable tokenization of a line, whitespace and comments included
+type LineTokens struct {
+	Line   int           `json:"line"` // line number, counting from 1
+	Tokens []TokenResult `json:"tokens"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// TokenizationJSON returns the raw tokens of each line in a form suitable for JSON serialization
+func (graph *ExecutionGraph) TokenizationJSON() []LineTokens {
+	results := []LineTokens{}
+
+	// the statements on the same line of code are merged
+	for _, line := range graph.Lines {
+		if len(results) <= line.SourceLine {
+			results = append(results, LineTokens{Line: line.SourceLine + 1, Tokens: []TokenResult{}})
+		}
+		result := &results[line.SourceLine]
+
+		if line.HasError() && result.Error == "" {
+			result.Error = line.Error.Error()
 		}
+
+		for _, token := range line.RawTokens {
+			result.Tokens = append(result.Tokens, TokenResult{token.Kind, token.Value, token.Start, token.End})
+		}
+	}
+
+	return results
+}
+
+// LineAst is the serializable parse tree of a line
+type LineAst struct {
+	Line  int        `json:"line"` // line number, counting from 1
+	Name  string     `json:"name,omitempty"`
+	Ast   *AstResult `json:"ast"` // nil for lines with an error
+	Error string     `json:"error,omitempty"`
+}
+
+// AstJSON returns the parse tree of each line in a form suitable for JSON serialization
+func (graph *ExecutionGraph) AstJSON() []LineAst {
+	results := []LineAst{}
+
+	for i := range graph.Lines {
+		result := LineAst{Line: graph.Lines[i].SourceLine + 1, Name: graph.Lines[i].Name}
+
+		if graph.Lines[i].HasError() {
+			result.Error = graph.Lines[i].Error.Error()
+		} else {
+			ast := graph.Lines[i].Ast.Result()
+			result.Ast = &ast
+		}
+
+		results = append(results, result)
 	}
 
-	return result[:len(result)-1]
+	return results
 }
@@ -0,0 +1,2226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Parses and executes the source code, returning the first line
+func executeSource(sourceCode string) Line {
+	LoadUnitAliases()
+
+	graph, err := ParseCode(sourceCode)
+	if err != nil {
+		return Line{Error: err}
+	}
+	graph.Execute()
+
+	return graph.Lines[0]
+}
+
+func TestBreakdown(t *testing.T) {
+	LoadUnitAliases()
+
+	cases := map[string]string{
+		"breakdown(90000 [s])":           "1 day 1 hour",
+		"breakdown(3600 [s])":            "1 hour",
+		"breakdown(-90061 [s])":          "-1 day 1 hour 1 minute 1 second",
+		"breakdown(1234,5 [m])":          "1 km 234 m 50 cm",
+		"breakdown(0 [s])":               "0 seconds",
+		"x: breakdown(100 [min])\nx * 2": "x: 1 hour 40 minutes\n200 min",
+		"breakdown(5)":                   "! Breakdown must be applied to a duration or a length",
+		"breakdown(2 [kg])":              "! Breakdown must be applied to a duration or a length",
+	}
+
+	for source, expected := range cases {
+		graph, err := ParseCode(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		graph.Execute()
+
+		if result := graph.ExecutionResult(); result != expected {
+			t.Errorf("%q should be %q, got %q instead", source, expected, result)
+		}
+	}
+
+	graph, _ := ParseCode("breakdown(1,5 [h])")
+	graph.Execute()
+
+	if result := graph.ExecutionResultJSON()[0]; result.Text != "1 hour 30 minutes" || *result.Value != 1.5 || result.Unit != "hours" {
+		t.Errorf("The JSON result should keep the value and add the breakdown, got %+v instead", result)
+	}
+}
+
+func TestClamp(t *testing.T) {
+	line := executeSource("clamp(15, 0, 10)")
+	if line.HasError() || line.Value != 10 {
+		t.Errorf("clamp(15, 0, 10) should be 10, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("clamp(-3, 0, 10)")
+	if line.HasError() || line.Value != 0 {
+		t.Errorf("clamp(-3, 0, 10) should be 0, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("clamp(50 [cm], 1 [m], 2 [m])")
+	if line.HasError() || line.Value != 100 || line.Unit.String() != "cm" {
+		t.Errorf("clamp(50 [cm], 1 [m], 2 [m]) should be 100 cm, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("clamp(5, 10, 0)")
+	if !line.HasError() {
+		t.Errorf("clamp(5, 10, 0) should fail because the bounds are inverted")
+	}
+
+	line = executeSource("clamp(5 [m], 1 [s], 10 [s])")
+	if !line.HasError() {
+		t.Errorf("clamp with incompatible units should fail")
+	}
+
+	line = executeSource("clamp(5, 1)")
+	if !line.HasError() {
+		t.Errorf("clamp with 2 arguments should fail")
+	}
+}
+
+func TestHypot(t *testing.T) {
+	line := executeSource("hypot(3, 4)")
+	if line.HasError() || line.Value != 5 {
+		t.Errorf("hypot(3, 4) should be 5, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("hypot(30 [cm], 0,4 [m])")
+	if line.HasError() || line.Value != 50 || line.Unit.String() != "cm" {
+		t.Errorf("hypot(30 [cm], 0,4 [m]) should be 50 cm, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("hypot(3 [m], 4 [s])")
+	if !line.HasError() {
+		t.Errorf("hypot with incompatible units should fail")
+	}
+}
+
+func TestCombinatorics(t *testing.T) {
+	line := executeSource("ncr(5, 2)")
+	if line.HasError() || line.Value != 10 {
+		t.Errorf("ncr(5, 2) should be 10, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("npr(5, 2)")
+	if line.HasError() || line.Value != 20 {
+		t.Errorf("npr(5, 2) should be 20, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("ncr(60, 30)")
+	if line.HasError() || line.Value != 118264581564861424 {
+		t.Errorf("ncr(60, 30) should be 118264581564861424, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("ncr(2, 5)")
+	if !line.HasError() {
+		t.Errorf("ncr(2, 5) should fail because k > n")
+	}
+
+	line = executeSource("npr(5,5 , 2)")
+	if !line.HasError() {
+		t.Errorf("npr with a non-integer argument should fail")
+	}
+
+	line = executeSource("npr(10^17, 2)")
+	if line.HasError() || line.Value != 1e34 {
+		t.Errorf("npr(10^17, 2) should be 1e34, got %g (%v) instead", line.Value, line.Error)
+	}
+
+	// too many factors to multiply one at a time
+	for _, source := range []string{"ncr(10^17, 5*10^16)", "npr(10^17, 5*10^16)", "ncr(3000, 1500)"} {
+		line = executeSource(source)
+		if line.Error == nil || line.Error.Error() != "The result is infinite" {
+			t.Errorf("%s should be infinite, got %g (%v) instead", source, line.Value, line.Error)
+		}
+	}
+}
+
+func TestTruncFrac(t *testing.T) {
+	line := executeSource("trunc(-2,75 [m])")
+	if line.HasError() || line.Value != -2 || line.Unit.String() != "m" {
+		t.Errorf("trunc(-2,75 [m]) should be -2 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("frac(-2,75 [m])")
+	if line.HasError() || line.Value != -0.75 || line.Unit.String() != "m" {
+		t.Errorf("frac(-2,75 [m]) should be -0.75 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestRoundDecimals(t *testing.T) {
+	line := executeSource("round(3,14159)")
+	if line.HasError() || line.Value != 3 {
+		t.Errorf("round(3,14159) should be 3, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("round(3,14159, 2)")
+	if line.HasError() || line.Value != 3.14 {
+		t.Errorf("round(3,14159, 2) should be 3.14, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("round(3,14159, 1,5)")
+	if !line.HasError() {
+		t.Errorf("round with non-integer decimal places should fail")
+	}
+
+	line = executeSource("round(3,14159, -1)")
+	if !line.HasError() {
+		t.Errorf("round with negative decimal places should fail")
+	}
+
+	// the dot separates the thousands, so 3.14159 is rejected instead of being read as 314159
+	line = executeSource("round(3.14159, 2)")
+	if line.Error == nil || !strings.HasPrefix(line.Error.Error(), "Invalid number literal") {
+		t.Errorf("round(3.14159, 2) should fail with the decimal comma, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	graph, _ := ParseCode("round(3.14159, 2)")
+	graph.DecimalSeparator = "."
+	graph.Execute()
+	if line := graph.Lines[0]; line.HasError() || line.Value != 3.14 {
+		t.Errorf("round(3.14159, 2) should be 3.14 with the decimal point, got %f (%v) instead", line.Value, line.Error)
+	}
+}
+
+func TestConstants(t *testing.T) {
+	line := executeSource("tau")
+	if line.HasError() || line.Value != 2*math.Pi {
+		t.Errorf("tau should be 2pi, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("phi^2 - phi")
+	if line.HasError() || math.Abs(line.Value-1) > 1e-12 {
+		t.Errorf("phi^2 - phi should be 1, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	graph := ExecutionGraph{SourceCode: "tau + phi"}
+	graph.Tokenize(true)
+	if !strings.Contains(graph.ColorizedHTML(), `<span class="calc-token-constant" data-start="6" data-end="9">phi</span>`) {
+		t.Errorf("phi should be colorized as a constant")
+	}
+}
+
+func TestPhysicalConstants(t *testing.T) {
+	line := executeSource("c [km/s]")
+	if line.HasError() || math.Abs(line.Value-299792.458) > 1e-6 || line.Unit.String() != "km / s" {
+		t.Errorf("c [km/s] should be 299792.458 km / s, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(80 [kg]) * g [N]")
+	if line.HasError() || math.Abs(line.Value-784.532) > 1e-9 {
+		t.Errorf("(80 [kg]) * g [N] should be 784.532 N, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("k_B * (300 [K]) * N_A [J/mol]")
+	if line.HasError() || math.Abs(line.Value-2494.338785) > 1e-6 {
+		t.Errorf("k_B * (300 [K]) * N_A [J/mol] should be 2494.338785 J / mol, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("h * (1 [GHz]) [J]")
+	if line.HasError() || math.Abs(line.Value-6.62607015e-25) > 1e-35 {
+		t.Errorf("h * (1 [GHz]) [J] should be 6.62607015e-25 J, got %g %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	// variables override the physical constants
+	graph, err := ParseCode("c: 3\nc * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+	if line := graph.Lines[1]; line.HasError() || line.Value != 6 || !line.Unit.IsEmpty() {
+		t.Errorf("c should refer to the variable, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+	if result := graph.ColorizedHTML(); strings.Contains(result, "calc-token-constant") {
+		t.Errorf("c should not be colorized as a constant, got %s instead", result)
+	}
+
+	graph = ExecutionGraph{SourceCode: "c\npi", AllowedConstants: []string{"pi"}}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+	if line := graph.Lines[0]; line.Error == nil || !strings.HasPrefix(line.Error.Error(), "Constant c is not permitted") {
+		t.Errorf("c should not be permitted, got %v instead", line.Error)
+	}
+	if line := graph.Lines[1]; line.HasError() || line.Value != math.Pi {
+		t.Errorf("pi should be permitted, got %f (%v) instead", line.Value, line.Error)
+	}
+}
+
+func TestAngleConversionFunctions(t *testing.T) {
+	line := executeSource("degrees(pi)")
+	if line.HasError() || line.Value != 180 || line.Unit.String() != "deg" {
+		t.Errorf("degrees(pi) should be 180 deg, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("radians(180)")
+	if line.HasError() || line.Value != math.Pi || line.Unit.String() != "rad" {
+		t.Errorf("radians(180) should be pi rad, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("radians(90 [deg])")
+	if line.HasError() || line.Value != math.Pi/2 || line.Unit.String() != "rad" {
+		t.Errorf("radians(90 [deg]) should be pi/2 rad, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("degrees(3 [m])")
+	if !line.HasError() {
+		t.Errorf("degrees of a length should fail")
+	}
+}
+
+func TestTrigonometryWithAngleUnits(t *testing.T) {
+	line := executeSource("sin(90 [deg])")
+	if line.HasError() || line.Value != 1 || !line.Unit.IsEmpty() {
+		t.Errorf("sin(90 [deg]) should be 1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("cos(pi [rad])")
+	if line.HasError() || line.Value != -1 || !line.Unit.IsEmpty() {
+		t.Errorf("cos(pi [rad]) should be -1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("tan(45 [degrees])")
+	if line.HasError() || math.Abs(line.Value-1) > 1e-12 || !line.Unit.IsEmpty() {
+		t.Errorf("tan(45 [degrees]) should be 1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("sin(100 [grad])")
+	if line.HasError() || math.Abs(line.Value-1) > 1e-12 || !line.Unit.IsEmpty() {
+		t.Errorf("sin(100 [grad]) should be 1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("cos(200 [gon])")
+	if line.HasError() || math.Abs(line.Value+1) > 1e-12 {
+		t.Errorf("cos(200 [gon]) should be -1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(50 [gradians]) [deg]")
+	if line.HasError() || math.Abs(line.Value-45) > 1e-12 || line.Unit.String() != "deg" {
+		t.Errorf("(50 [gradians]) [deg] should be 45 deg, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("sin((3 [deg/s]) * (30 [s]))")
+	if line.HasError() || math.Abs(line.Value-1) > 1e-12 || !line.Unit.IsEmpty() {
+		t.Errorf("sin((3 [deg/s]) * (30 [s])) should be 1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("sin(90 [deg m / m])")
+	if line.HasError() || math.Abs(line.Value-1) > 1e-12 || !line.Unit.IsEmpty() {
+		t.Errorf("sin(90 [deg m / m]) should be 1, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	// only the numbers with no unit are radians
+	for _, source := range []string{"sin(1 [m])", "cos(2 [deg/s])", "tan(1 [rad^2])"} {
+		line = executeSource(source)
+		if !line.HasError() || line.Error.Error() != "Units are not compatible" {
+			t.Errorf("%s should fail since the argument is not an angle, got %f %s (%v) instead", source, line.Value, line.Unit, line.Error)
+		}
+	}
+
+	graph := ExecutionGraph{SourceCode: "sin(1 [m])"}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if graph.CheckUnits() {
+		t.Errorf("The validation should reject sin(1 [m])")
+	}
+
+	line = executeSource("radians(100 [grad])")
+	if line.HasError() || math.Abs(line.Value-math.Pi/2) > 1e-12 {
+		t.Errorf("radians(100 [grad]) should be pi/2 rad, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestDerivedUnitsExecution(t *testing.T) {
+	line := executeSource("(2 [kg]) * (3 [m/s^2]) [N]")
+	if line.HasError() || line.Value != 6 || line.Unit.String() != "N" {
+		t.Errorf("(2 [kg]) * (3 [m/s^2]) [N] should be 6 N, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(1 [N]) + (500 [g m / s^2])")
+	if line.HasError() || line.Value != 1.5 || line.Unit.String() != "N" {
+		t.Errorf("(1 [N]) + (500 [g m / s^2]) should be 1.5 N, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestSpeedUnits(t *testing.T) {
+	line := executeSource("(60 [mph]) [km/h]")
+	if line.HasError() || math.Abs(line.Value-96.56064) > 1e-9 || line.Unit.String() != "km / hours" {
+		t.Errorf("(60 [mph]) [km/h] should be 96.56064 km / hours, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(100 [m]) / (10 [s]) [kmh]")
+	if line.HasError() || math.Abs(line.Value-36) > 1e-9 || line.Unit.String() != "km/h" {
+		t.Errorf("(100 [m]) / (10 [s]) [kmh] should be 36 km/h, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(10 [knots]) [m/s]")
+	if line.HasError() || math.Abs(line.Value-5.144444444444) > 1e-9 {
+		t.Errorf("(10 [knots]) [m/s] should be 5.1444 m / s, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestFrequencyUnits(t *testing.T) {
+	line := executeSource("1/(20 [ms]) [Hz]")
+	if line.HasError() || math.Abs(line.Value-50) > 1e-9 || line.Unit.String() != "Hz" {
+		t.Errorf("1/(20 [ms]) [Hz] should be 50 Hz, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(2 [GHz]) [1/s]")
+	if line.HasError() || line.Value != 2*math.Pow10(9) {
+		t.Errorf("(2 [GHz]) [1/s] should be 2e9 1 / s, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestElectricalUnits(t *testing.T) {
+	line := executeSource("(12 [V]) / (2 [A]) [ohm]")
+	if line.HasError() || line.Value != 6 || line.Unit.String() != "Ω" {
+		t.Errorf("(12 [V]) / (2 [A]) [ohm] should be 6 Ω, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(3 [A]) * (2 [s]) [coulomb]")
+	if line.HasError() || line.Value != 6 {
+		t.Errorf("(3 [A]) * (2 [s]) [coulomb] should be 6 coulomb, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(10 [coulomb]) / (5 [V]) [uF]")
+	if line.HasError() || math.Abs(line.Value-2*math.Pow10(6)) > 1e-6 {
+		t.Errorf("(10 [coulomb]) / (5 [V]) [uF] should be 2e6 µF, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(2 [A]) * (5 [V]) [W]")
+	if line.HasError() || line.Value != 10 {
+		t.Errorf("(2 [A]) * (5 [V]) [W] should be 10 W, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestUnitConstantsSheet(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, err := ParseCode("speed: 60 [km/h]\nduration: 90 [min]\ndistance: speed * duration\nback: distance / speed [min]\ntotal: speed * (2 [hours]) + distance\ntrip: speed * 2 [hours]\nconverted: speed * pi [m/s]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	// a unit following a number applies to it alone, e.g. 2 [hours], and converts the expression otherwise
+	expected := []struct {
+		value float64
+		unit  string
+	}{{60, "km / hours"}, {90, "min"}, {90, "km"}, {90, "min"}, {210, "km"}, {120, "km"}, {60 * math.Pi / 3.6, "m / s"}}
+
+	for i, result := range expected {
+		line := graph.Lines[i]
+
+		if line.HasError() || math.Abs(line.Value-result.value) > 1e-9 || line.Unit.String() != result.unit {
+			t.Errorf("%s should be %f %s, got %f %s (%v) instead", line.Name, result.value, result.unit, line.Value, line.Unit, line.Error)
+		}
+	}
+}
+
+func TestFuelEconomyUnits(t *testing.T) {
+	LoadUnitAliases()
+
+	line := executeSource("(30 [mpg]) [L/100km]")
+	if line.HasError() || math.Abs(line.Value-7.840486) > 1e-6 || line.Unit.String() != "L/100km" {
+		t.Errorf("(30 [mpg]) [L/100km] should be 7.840486 L/100km, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("5 [L / 100 km] in [km/L]")
+	if line.HasError() || math.Abs(line.Value-20) > 1e-9 || line.Unit.String() != "km / L" {
+		t.Errorf("5 [L / 100 km] in [km/L] should be 20 km / L, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(20 [kmpl]) [mpg]")
+	if line.HasError() || math.Abs(line.Value-47.042917) > 1e-6 {
+		t.Errorf("(20 [kmpl]) [mpg] should be 47.042917 mpg, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(0 [mpg]) [L/100km]")
+	if !line.HasError() {
+		t.Errorf("A fuel economy of 0 should not convert to a fuel consumption")
+	}
+
+	// the reciprocal conversion is reserved to the fuel units
+	line = executeSource("(2 [s]) [Hz]")
+	if !line.HasError() {
+		t.Errorf("Seconds should not convert to hertz, got %f %s instead", line.Value, line.Unit)
+	}
+
+	// only the explicit conversions are reciprocal, the operations cannot mix fuel economies and consumptions
+	for _, source := range []string{
+		"(1 [mpg]) + (1 [L/100km])",
+		"(30 [mpg]) - (5 [L/100km])",
+		"clamp(30 [mpg], 5 [L/100km], 10 [L/100km])",
+		"30 [mpg]\n5 [L/100km]\nsum(line1, line2)",
+		"30 [mpg]\n5 [L/100km]\navg(line1, line2)",
+	} {
+		graph, err := ParseCode(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if graph.CheckUnits() {
+			t.Errorf("%s should fail the unit check", source)
+		}
+
+		graph.Execute()
+		if line := graph.Lines[len(graph.Lines)-1]; line.Error == nil {
+			t.Errorf("%s should fail, got %f %s instead", source, line.Value, line.Unit)
+		}
+	}
+}
+
+func TestTimeUnits(t *testing.T) {
+	LoadUnitAliases()
+
+	line := executeSource("(2 [wk]) [days]")
+	if line.HasError() || line.Value != 14 {
+		t.Errorf("(2 [wk]) [days] should be 14 days, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(3 [µs]) [ns]")
+	if line.HasError() || math.Abs(line.Value-3000) > 1e-9 {
+		t.Errorf("(3 [µs]) [ns] should be 3000 ns, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(2 [centuries]) [decades]")
+	if line.HasError() || math.Abs(line.Value-20) > 1e-9 {
+		t.Errorf("(2 [centuries]) [decades] should be 20 decades, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(1 [decade]) [years]")
+	if line.HasError() || math.Abs(line.Value-10) > 1e-9 {
+		t.Errorf("(1 [decade]) [years] should be 10 years, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestAmountOfSubstanceUnits(t *testing.T) {
+	line := executeSource("(0,5 [mol/L]) [mmol/mL]")
+	if line.HasError() || math.Abs(line.Value-0.5) > 1e-12 || line.Unit.String() != "mmol / mL" {
+		t.Errorf("(0,5 [mol/L]) [mmol/mL] should be 0.5 mmol / mL, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(2 [kmol]) [mol]")
+	if line.HasError() || line.Value != 2000 {
+		t.Errorf("(2 [kmol]) [mol] should be 2000 mol, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(2 [mol]) [g]")
+	if !line.HasError() {
+		t.Errorf("Moles should not convert to grams")
+	}
+}
+
+func TestMetricPrefixes(t *testing.T) {
+	LoadUnitAliases()
+
+	line := executeSource("(101,325 [kPa]) [hPa]")
+	if line.HasError() || math.Abs(line.Value-1013.25) > 1e-9 || line.Unit.String() != "hPa" {
+		t.Errorf("(101,325 [kPa]) [hPa] should be 1013.25 hPa, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(250 [µs]) + (1 [ms]) [us]")
+	if line.HasError() || math.Abs(line.Value-1250) > 1e-9 {
+		t.Errorf("(250 [µs]) + (1 [ms]) [us] should be 1250 μs, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(2 [MW]) * (3 [hours]) [gigajoules]")
+	if line.HasError() || math.Abs(line.Value-21.6) > 1e-9 || line.Unit.String() != "GJ" {
+		t.Errorf("(2 [MW]) * (3 [hours]) [gigajoules] should be 21.6 GJ, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(4,7 [nanofarad]) [pF]")
+	if !line.HasError() {
+		t.Errorf("Farads have no symbol to prefix, pF should not be a unit")
+	}
+
+	// the units in the table take precedence over the generated ones
+	if unit := UnitTable["kilogram"]; unit.ConversionFactor != 1 || UnitAliasesMap["Mg"] != "megagram" || UnitAliasesMap["megagram"] != "tonne" {
+		t.Errorf("The generated units should not replace the ones in the table, got %v instead", unit)
+	}
+}
+
+func TestAreaUnits(t *testing.T) {
+	line := executeSource("(100 [m]) * (100 [m]) [hectare]")
+	if line.HasError() || line.Value != 1 || line.Unit.String() != "ha" {
+		t.Errorf("(100 [m]) * (100 [m]) [hectare] should be 1 ha, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("100 [m] * 100 [m] in [hectare]")
+	if line.HasError() || math.Abs(line.Value-1) > 1e-12 || line.Unit.String() != "ha" {
+		t.Errorf("100 [m] * 100 [m] in [hectare] should be 1 ha, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(1 [acre]) [ft^2]")
+	if line.HasError() || math.Abs(line.Value-43560) > 1e-6 {
+		t.Errorf("(1 [acre]) [ft^2] should be 43560 ft^2, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestUnitDeclaration(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, _ := ParseCode("unit furlong = 201,168 [m]\n(2 [furlong]) [m]\n(1 [km]) [furlong]\nunit barrel = 42 [gal]\n(1 [barrel]) [L]\nunit m = 3 [ft]")
+	graph.Execute()
+
+	if graph.Lines[0].HasError() || graph.Lines[0].Value != 201.168 {
+		t.Errorf("The unit declaration should evaluate to its definition, got %f (%v) instead", graph.Lines[0].Value, graph.Lines[0].Error)
+	}
+
+	if graph.Lines[1].HasError() || math.Abs(graph.Lines[1].Value-402.336) > 1e-9 {
+		t.Errorf("(2 [furlong]) [m] should be 402.336 m, got %f (%v) instead", graph.Lines[1].Value, graph.Lines[1].Error)
+	}
+
+	if graph.Lines[2].HasError() || math.Abs(graph.Lines[2].Value-4.970969537899) > 1e-9 || graph.Lines[2].Unit.String() != "furlong" {
+		t.Errorf("(1 [km]) [furlong] should be 4.97 furlong, got %f %s (%v) instead", graph.Lines[2].Value, graph.Lines[2].Unit, graph.Lines[2].Error)
+	}
+
+	if graph.Lines[4].HasError() || math.Abs(graph.Lines[4].Value-158.987294928) > 1e-9 {
+		t.Errorf("(1 [barrel]) [L] should be 158.987 L, got %f (%v) instead", graph.Lines[4].Value, graph.Lines[4].Error)
+	}
+
+	if !graph.Lines[5].HasError() {
+		t.Errorf("Redefining an existing unit should fail")
+	}
+
+	if _, ok := UnitAliasesMap["furlong"]; ok {
+		t.Errorf("Declared units should not be added to the global aliases")
+	}
+}
+
+func TestSubtractionKeepsUnit(t *testing.T) {
+	line := executeSource("(5 [m]) - (20 [cm])")
+	if line.HasError() || line.Value != 4.8 || line.Unit.String() != "m" {
+		t.Errorf("(5 [m]) - (20 [cm]) should be 4.8 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestTemperatureRates(t *testing.T) {
+	line := executeSource("(5 [K/hour]) + (3 [K/hour])")
+	if line.HasError() || line.Value != 8 || line.Unit.String() != "K / hours" {
+		t.Errorf("(5 [K/hour]) + (3 [K/hour]) should be 8 K / hours, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	// the second operand of a sum or a difference is an interval, so its shift is not applied
+	line = executeSource("(5 [°C]) + (3 [K])")
+	if line.HasError() || math.Abs(line.Value-8) > 1e-9 || line.Unit.String() != "°C" {
+		t.Errorf("(5 [°C]) + (3 [K]) should be 8 °C, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(50 [°F]) - (10 [°C])")
+	if line.HasError() || math.Abs(line.Value-32) > 1e-9 {
+		t.Errorf("(50 [°F]) - (10 [°C]) should be 32 °F, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	// the products keep the offset only for a plain temperature
+	for _, source := range []string{"(1 [°C]) * (1 [°F])", "(1 [°C]) * (1 [K])", "(2 [°C]) * (3 [m])", "(6 [°F]) / (2 [°C])", "(5 [°C])^2", "sqrt(4 [°C])"} {
+		line = executeSource(source)
+		if !line.HasError() || !strings.Contains(line.Error.Error(), "offset") {
+			t.Errorf("%s should fail since temperatures cannot be multiplied, got %f %s (%v) instead", source, line.Value, line.Unit, line.Error)
+		}
+
+		graph := ExecutionGraph{SourceCode: source}
+		if err := graph.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		if graph.CheckUnits() {
+			t.Errorf("The validation should reject %s", source)
+		}
+	}
+
+	line = executeSource("(5 [°C]) * 2")
+	if line.HasError() || line.Value != 10 || line.Unit.String() != "°C" {
+		t.Errorf("(5 [°C]) * 2 should be 10 °C, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(5 [°C/hour]) * (2 [hours])")
+	if line.HasError() || line.Value != 10 || line.Unit.String() != "°C" {
+		t.Errorf("(5 [°C/hour]) * (2 [hours]) should be 10 °C, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(5 [K/hour]) [C/hour]")
+	if !line.HasError() {
+		t.Errorf("Converting K / hours to °C / hours should fail")
+	}
+}
+
+func TestCancelledUnitAsExponent(t *testing.T) {
+	line := executeSource("2^((10 [m]) / (2 [m]))")
+	if line.HasError() || line.Value != 32 || !line.Unit.IsEmpty() {
+		t.Errorf("2^((10 [m]) / (2 [m])) should be 32, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestProductAndDivisionUnits(t *testing.T) {
+	line := executeSource("(3 [m]) * (2 [s])")
+	if line.HasError() || line.Value != 6 || line.Unit.String() != "m s" {
+		t.Errorf("(3 [m]) * (2 [s]) should be 6 m s, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(3 [m]) / (2 [s])")
+	if line.HasError() || line.Value != 1.5 || line.Unit.String() != "m / s" {
+		t.Errorf("(3 [m]) / (2 [s]) should be 1.5 m / s, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestEmptyExpressions(t *testing.T) {
+	cases := map[string]string{
+		"[m]":       "The expression is empty",
+		"[m] * [s]": "Cannot end expression with operation",
+		"()":        "The expression is empty",
+		"2 * ()":    "The expression is empty",
+		"x: [m]":    "The expression is empty",
+		"[L/100km]": "The expression is empty",
+		`ascii ""`:  "You must pass a non-empty string to the ascii method",
+		`""`:        `Strings can only be passed to methods, e.g. ascii "a"`,
+	}
+
+	for source, expected := range cases {
+		graph, err := ParseCode(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		graph.LaTeX()
+		if graph.CheckUnits() {
+			t.Errorf("%s should fail the unit check", source)
+		}
+
+		graph.Execute()
+		if line := graph.Lines[0]; line.Error == nil || line.Error.Error() != expected {
+			t.Errorf("%s should fail with '%s', got %v instead", source, expected, line.Error)
+		}
+	}
+}
+
+func TestCyclicalDefinitions(t *testing.T) {
+	_, err := ParseCode("a: b + 1\nb: c * 2\nc: a\nd: 5")
+	if err == nil || err.Error() != "Cyclical definitions detected: a -> b -> c -> a" {
+		t.Errorf("Cyclical definitions should be reported naming the variables, got %v instead", err)
+	}
+
+	_, err = ParseCode("a: 1\nb: a + a\nb * 2")
+	if err != nil {
+		t.Errorf("Acyclic definitions should not fail, got %v instead", err)
+	}
+}
+
+func TestTokenizerLineEndings(t *testing.T) {
+	tokens, err := tokenizer("1 + 2\r", false)
+	if err != nil || len(removeNonSemanticTokens(tokens)) != 3 {
+		t.Errorf("Carriage returns should be tokenized as whitespace, got %v (%v) instead", tokens, err)
+	}
+
+	_, err = tokenizer("1 + 2\n3", true)
+	if err == nil {
+		t.Errorf("Tokenizing multiple lines should fail")
+	}
+
+	line := executeSource("1 + 2\r")
+	if line.HasError() || line.Value != 3 {
+		t.Errorf("1 + 2 with CRLF line ending should be 3, got %f (%v) instead", line.Value, line.Error)
+	}
+}
+
+func TestTokenOffsets(t *testing.T) {
+	line := "x: 0x1F ** 2,5 [μm] + \"é\"; |y| # €"
+	tokens, err := tokenizer(line, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := []rune(line)
+	for i, token := range tokens {
+		if token.Kind != "string" && string(source[token.Start:token.End]) != token.Value {
+			t.Errorf("The offsets of %v should cover its value, got %q instead", token, string(source[token.Start:token.End]))
+		}
+
+		if i+1 < len(tokens) && token.End != tokens[i+1].Start {
+			t.Errorf("%v should end where %v starts, got %d instead", token, tokens[i+1], token.End)
+		}
+	}
+
+	if last := tokens[len(tokens)-1]; last.End != len(source) {
+		t.Errorf("The last token should end at %d, got %d instead", len(source), last.End)
+	}
+}
+
+func TestDecimalSeparator(t *testing.T) {
+	graph, _ := ParseCode("1.000,5\n1,000.5")
+	graph.Execute()
+
+	if graph.Lines[0].Value != 1000.5 {
+		t.Errorf("1.000,5 should be 1000.5 with the default decimal comma, got %f instead", graph.Lines[0].Value)
+	}
+
+	graph, _ = ParseCode("1.000,5\n1,000.5")
+	graph.DecimalSeparator = "."
+	graph.Execute()
+
+	if graph.Lines[1].Value != 1000.5 {
+		t.Errorf("1,000.5 should be 1000.5 with the decimal point, got %f instead", graph.Lines[1].Value)
+	}
+
+	for _, source := range []string{"3.14", "1.00.000", ".500", "1,5.000", "1000.00%"} {
+		if line := executeSource(source); !line.HasError() {
+			t.Errorf("%s should be an invalid number with the decimal comma, got %f instead", source, line.Value)
+		}
+	}
+
+	line := executeSource("1.000.000,5 + 12.345%")
+	if line.HasError() || line.Value != 1000123.95 {
+		t.Errorf("1.000.000,5 + 12.345%% should be 1000123.95, got %f (%v) instead", line.Value, line.Error)
+	}
+}
+
+func TestHexadecimalAndBinaryLiterals(t *testing.T) {
+	line := executeSource("0xFF + 0b1010")
+	if line.HasError() || line.Value != 265 {
+		t.Errorf("0xFF + 0b1010 should be 265, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("0x10 * 2")
+	if line.HasError() || line.Value != 32 {
+		t.Errorf("0x10 * 2 should be 32, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	graph, _ := ParseCode("0x1000")
+	graph.DecimalSeparator = "."
+	graph.Execute()
+	if graph.Lines[0].Value != 4096 {
+		t.Errorf("0x1000 should be 4096 regardless of the decimal separator, got %f instead", graph.Lines[0].Value)
+	}
+}
+
+func TestConversionKeywords(t *testing.T) {
+	line := executeSource("5 [km] in [m]")
+	if line.HasError() || line.Value != 5000 || line.Unit.String() != "m" {
+		t.Errorf("5 [km] in [m] should be 5000 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("(1 [kg]) + (500 [g]) to [g]")
+	if line.HasError() || line.Value != 1500 || line.Unit.String() != "g" {
+		t.Errorf("(1 [kg]) + (500 [g]) to [g] should be 1500 g, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("5 [km] in [s]")
+	if !line.HasError() || line.Error.Error() != "Cannot convert km to s" {
+		t.Errorf("5 [km] in [s] should fail with a clear error, got %v instead", line.Error)
+	}
+
+	line = executeSource("5 in [s]")
+	if !line.HasError() {
+		t.Errorf("Converting a number with no unit should fail")
+	}
+
+	line = executeSource("5 [km] in [m] + 3")
+	if !line.HasError() {
+		t.Errorf("A conversion in the middle of an expression should fail")
+	}
+}
+
+func TestImplicitMultiplication(t *testing.T) {
+	line := executeSource("2pi")
+	if line.HasError() || line.Value != 2*math.Pi {
+		t.Errorf("2pi should be 2*pi, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("3(4+1)")
+	if line.HasError() || line.Value != 15 {
+		t.Errorf("3(4+1) should be 15, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2 e + 1")
+	if line.HasError() || line.Value != 2*math.E+1 {
+		t.Errorf("2 e + 1 should be 2*e+1, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2 sin(pi)/2 + 1")
+	if line.HasError() || line.Value != 2*math.Sin(math.Pi)/2+1 {
+		t.Errorf("2 sin(pi)/2 + 1 should be 2*sin(pi)/2+1, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("(2)(3 [m])")
+	if line.HasError() || line.Value != 6 || line.Unit.String() != "m" {
+		t.Errorf("(2)(3 [m]) should be 6 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("2 3")
+	if !line.HasError() {
+		t.Errorf("Two adjacent numbers should fail")
+	}
+}
+
+func TestFactorial(t *testing.T) {
+	line := executeSource("5!")
+	if line.HasError() || line.Value != 120 {
+		t.Errorf("5! should be 120, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2^3! + factorial(3)")
+	if line.HasError() || line.Value != 70 {
+		t.Errorf("2^3! + factorial(3) should be 70, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("0! * 3!pi")
+	if line.HasError() || line.Value != 6*math.Pi {
+		t.Errorf("0! * 3!pi should be 6pi, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2,5!")
+	if !line.HasError() {
+		t.Errorf("The factorial of a non-integer should fail")
+	}
+
+	line = executeSource("(3 [m])!")
+	if !line.HasError() {
+		t.Errorf("The factorial of a number with a unit should fail")
+	}
+
+	line = executeSource("!3")
+	if !line.HasError() {
+		t.Errorf("A factorial without operand should fail")
+	}
+
+	// the numbers too large to loop over, e.g. from 2^53 on i++ leaves i unchanged, are infinite
+	for _, source := range []string{"factorial(10^16)", "(10^16)!", "171!"} {
+		line = executeSource(source)
+		if line.Error == nil || line.Error.Error() != "The result is infinite" {
+			t.Errorf("%s should be infinite, got %f (%v) instead", source, line.Value, line.Error)
+		}
+	}
+}
+
+func TestUnaryMinus(t *testing.T) {
+	cases := map[string]float64{
+		"2*-3":            -6,
+		"-(-5)":           5,
+		"3 - -2":          5,
+		"2 ^ -1":          0.5,
+		"2 * -3^2":        -18,
+		"-2^2":            -4,
+		"2 * --3":         6,
+		"3! - 2":          4,
+		"hypot(-3, 2*-2)": 5,
+		"(-2 [m]) * -1":   2,
+	}
+
+	for source, expected := range cases {
+		line := executeSource(source)
+
+		if line.HasError() || math.Abs(line.Value-expected) > 1e-12 {
+			t.Errorf("%s should be %f, got %f (%v) instead", source, expected, line.Value, line.Error)
+		}
+	}
+
+	// the minus is parsed, the square root of a negative number is not real
+	line := executeSource("sqrt(-4)")
+	if line.Error == nil || line.Error.Error() != "The result is not a real number" {
+		t.Errorf("sqrt(-4) should not be a real number, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2 * -")
+	if !line.HasError() {
+		t.Errorf("A minus without operand should fail")
+	}
+}
+
+func TestAbsoluteValueBars(t *testing.T) {
+	line := executeSource("|3 - 5| * 2")
+	if line.HasError() || line.Value != 4 {
+		t.Errorf("|3 - 5| * 2 should be 4, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("|(2 [m]) - (5 [m])|")
+	if line.HasError() || line.Value != 3 || line.Unit.String() != "m" {
+		t.Errorf("|(2 [m]) - (5 [m])| should be 3 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("||-2||")
+	if !line.HasError() {
+		t.Errorf("Nested absolute value bars should fail")
+	}
+
+	line = executeSource("|1 - |2||")
+	if !line.HasError() {
+		t.Errorf("Nested absolute value bars should fail")
+	}
+
+	line = executeSource("|-2")
+	if !line.HasError() {
+		t.Errorf("Unterminated absolute value bars should fail")
+	}
+}
+
+func TestPreviousResult(t *testing.T) {
+	graph, err := ParseCode("3 [m]\n\n# comment\nans * 2\nx: ans + (1 [m])\n(1 [m]) + (2 [s])\nans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if graph.Lines[3].HasError() || graph.Lines[3].Value != 6 || graph.Lines[3].Unit.String() != "m" {
+		t.Errorf("ans * 2 should be 6 m, got %f %s (%v) instead", graph.Lines[3].Value, graph.Lines[3].Unit, graph.Lines[3].Error)
+	}
+
+	if graph.Lines[4].HasError() || graph.Lines[4].Value != 7 {
+		t.Errorf("x: ans + (1 [m]) should be 7 m, got %f (%v) instead", graph.Lines[4].Value, graph.Lines[4].Error)
+	}
+
+	if !graph.Lines[6].HasError() {
+		t.Errorf("ans should fail when the previous line has an error")
+	}
+
+	line := executeSource("ans + 1")
+	if !line.HasError() {
+		t.Errorf("ans on the first line should fail")
+	}
+}
+
+func TestLineReferences(t *testing.T) {
+	graph, err := ParseCode("3 [m]\n\nline1 * 2\nline3 + line1\nline2\nline9\nline7 + 1\n5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if graph.Lines[2].HasError() || graph.Lines[2].Value != 6 || graph.Lines[2].Unit.String() != "m" {
+		t.Errorf("line1 * 2 should be 6 m, got %f %s (%v) instead", graph.Lines[2].Value, graph.Lines[2].Unit, graph.Lines[2].Error)
+	}
+
+	if graph.Lines[3].HasError() || graph.Lines[3].Value != 9 {
+		t.Errorf("line3 + line1 should be 9 m, got %f (%v) instead", graph.Lines[3].Value, graph.Lines[3].Error)
+	}
+
+	if !graph.Lines[4].HasError() {
+		t.Errorf("Referring to an empty line should fail")
+	}
+
+	if !graph.Lines[5].HasError() {
+		t.Errorf("Referring to a line out of range should fail")
+	}
+
+	if !graph.Lines[6].HasError() {
+		t.Errorf("Referring to a line below should fail")
+	}
+}
+
+func TestExecutionResultJSON(t *testing.T) {
+	graph, err := ParseCode("a: 3 [m]\n\n2 +")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	results := graph.ExecutionResultJSON()
+
+	if len(results) != 3 {
+		t.Fatalf("There should be 3 results, got %d instead", len(results))
+	}
+
+	if results[0].Line != 1 || results[0].Name != "a" || results[0].Value == nil || *results[0].Value != 3 || results[0].Unit != "m" {
+		t.Errorf("The first line should be a = 3 m, got %+v instead", results[0])
+	}
+
+	if !results[1].Empty || results[1].Value != nil {
+		t.Errorf("The second line should be empty, got %+v instead", results[1])
+	}
+
+	if results[2].Error == "" || results[2].Value != nil {
+		t.Errorf("The third line should have an error, got %+v instead", results[2])
+	}
+
+	// the values are serialized at full precision, however large or small
+	graph = ExecutionGraph{SourceCode: "factorial(170)\n10^300\nh\n0,00000000000001\n1/0", AllowInfinity: true}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	results = graph.ExecutionResultJSON()
+	for i, expected := range []float64{graph.Lines[0].Value, 1e300, 6.62607015e-34, 1e-14} {
+		if results[i].Value == nil || math.Abs(*results[i].Value-expected) > math.Abs(expected)*1e-12 {
+			t.Errorf("Line %d should be serialized as %g, got %+v instead", i+1, expected, results[i])
+		}
+	}
+	if results[4].Value != nil || results[4].Error == "" {
+		t.Errorf("An infinite result should be a line error, got %+v instead", results[4])
+	}
+
+	if _, err := json.Marshal(results); err != nil {
+		t.Errorf("The results should be serializable, got %v instead", err)
+	}
+}
+
+func TestExpressionResultJSON(t *testing.T) {
+	graph, err := ParseCode("(2 + 2) [m]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	result := graph.ExpressionResultJSON()
+	if result.Error != nil || result.Value == nil || *result.Value != 4 || *result.Unit != "m" {
+		t.Errorf("(2 + 2) [m] should be 4 m, got %+v instead", result)
+	}
+
+	cases := map[string]string{
+		"(2 [m]) + (3 [s])": "",
+		"":                  "The expression is empty",
+		"1\n2":              "The expression must be a single line",
+	}
+
+	for source, expectedError := range cases {
+		graph, err := ParseCode(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		graph.Execute()
+
+		result := graph.ExpressionResultJSON()
+
+		if result.Error == nil || result.Value != nil || result.Unit != nil {
+			t.Errorf("%q should have an error, got %+v instead", source, result)
+		} else if expectedError != "" && *result.Error != expectedError {
+			t.Errorf("The error of %q should be %s, got %s instead", source, expectedError, *result.Error)
+		}
+	}
+}
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	graph, err := ParseCode("1 + 2\n3 + $\n4 + )\n5 (\n\"abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]int{{2, 5}, {3, 5}, {4, 4}, {5, 1}}
+
+	for i, position := range expected {
+		syntaxError, ok := graph.Lines[i+1].Error.(SyntaxError)
+
+		if !ok {
+			t.Errorf("Line %d should have a syntax error, got %v instead", i+2, graph.Lines[i+1].Error)
+		} else if syntaxError.Line != position[0] || syntaxError.Column != position[1] {
+			t.Errorf("The error should be at line %d, column %d, got line %d, column %d instead", position[0], position[1], syntaxError.Line, syntaxError.Column)
+		}
+	}
+}
+
+func TestAllowedFunctionsAndUnits(t *testing.T) {
+	LoadUnitAliases()
+
+	graph := ExecutionGraph{
+		SourceCode:       "sqrt(16)\nsin(1)\n(1 [km]) [m]\n2 [kg]\n|0 - 3|\nx: 1; x",
+		AllowedFunctions: []string{"sqrt"},
+		AllowedUnits:     []string{"meter", "kilometer"},
+	}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if line := graph.Lines[0]; line.HasError() || line.Value != 4 {
+		t.Errorf("sqrt should be allowed, got %f (%v) instead", line.Value, line.Error)
+	}
+	if line := graph.Lines[2]; line.HasError() || line.Value != 1000 {
+		t.Errorf("km and m should be allowed, got %f (%v) instead", line.Value, line.Error)
+	}
+	if line := graph.Lines[5]; line.HasError() || line.Value != 1 {
+		t.Errorf("The variables should not be restricted, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	errors := map[int]string{1: "Function sin is not permitted", 3: "Unit kg is not permitted", 4: "Function abs is not permitted"}
+	for i, message := range errors {
+		if line := graph.Lines[i]; line.Error == nil || !strings.HasPrefix(line.Error.Error(), message) {
+			t.Errorf("Line %d should fail with %q, got %v instead", i+1, message, line.Error)
+		}
+	}
+
+	if line := executeSource("(sin(0) + 1) [kg]"); line.HasError() {
+		t.Errorf("Everything should be allowed without the allow-lists, got %v instead", line.Error)
+	}
+}
+
+func TestMismatchedDelimiters(t *testing.T) {
+	LoadUnitAliases()
+
+	cases := []struct {
+		source  string
+		message string
+		column  int
+	}{
+		{"(1 + 2]", "Mismatched ], expected )", 7},
+		{"2 [m)", "Mismatched ), expected ]", 5},
+		{"3 [(m/s]", "Mismatched ], expected )", 8},
+		{"hypot(3, 4]", "Mismatched ], expected )", 11},
+		{"|1 - 2)|", "Mismatched ), expected |", 7},
+		{"(1 + [m)]", "Mismatched ), expected ]", 8},
+		{"1 + 2)", "Unmatched )", 6},
+		{"4]", "Unmatched ]", 2},
+	}
+
+	for _, c := range cases {
+		err := executeSource(c.source).Error
+
+		if syntaxError, ok := err.(SyntaxError); !ok || syntaxError.Message != c.message || syntaxError.Column != c.column {
+			t.Errorf("%s should fail with %q at column %d, got %v instead", c.source, c.message, c.column, err)
+		}
+	}
+
+	if line := executeSource("(2 [m/(s)]) * hypot(3, (4))"); line.HasError() || line.Value != 10 {
+		t.Errorf("Nested delimiters should be matched, got %f (%v) instead", line.Value, line.Error)
+	}
+}
+
+func TestTokenizationJSON(t *testing.T) {
+	graph := ExecutionGraph{SourceCode: "a: \"xy\" # note\n\n2 @"}
+	graph.Tokenize(true)
+
+	lines := graph.TokenizationJSON()
+
+	if len(lines) != 3 || len(lines[1].Tokens) != 0 {
+		t.Fatalf("There should be 3 lines, the second empty, got %+v instead", lines)
+	}
+
+	expected := []TokenResult{
+		{"literal", "a", 0, 1},
+		{"definition", ":", 1, 2},
+		{"whitespace", " ", 2, 3},
+		{"string", "xy", 3, 7},
+		{"whitespace", " ", 7, 8},
+		{"comment", "# note", 8, 14},
+	}
+
+	if len(lines[0].Tokens) != len(expected) {
+		t.Fatalf("The first line should have %d tokens, got %+v instead", len(expected), lines[0].Tokens)
+	}
+
+	for i := range expected {
+		if lines[0].Tokens[i] != expected[i] {
+			t.Errorf("Token %d should be %+v, got %+v instead", i, expected[i], lines[0].Tokens[i])
+		}
+	}
+
+	if last := lines[2].Tokens[len(lines[2].Tokens)-1]; last.Kind != "unknown" || last.Start != 2 || last.End != 3 {
+		t.Errorf("The last token should be an unknown @ at 2-3, got %+v instead", last)
+	}
+}
+
+func TestAstJSON(t *testing.T) {
+	LoadUnitAliases()
+	graph, err := ParseCode("a: 2 + pi [m]\n2 +")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := graph.AstJSON()
+
+	if lines[0].Name != "a" || lines[0].Ast == nil || lines[0].Ast.Kind != "Expression" || lines[0].Ast.Unit != "m" || len(lines[0].Ast.Params) != 1 {
+		t.Fatalf("The first line should be an expression in m, got %+v instead", lines[0].Ast)
+	}
+
+	if sum := lines[0].Ast.Params[0]; sum.Kind != "Operator" || sum.Value != "+" || len(sum.Params) != 2 {
+		t.Errorf("The expression should contain a sum, got %+v instead", sum)
+	}
+
+	if lines[1].Ast != nil || lines[1].Error == "" {
+		t.Errorf("The second line should have an error, got %+v instead", lines[1])
+	}
+
+	// the cyclical definitions are errors of their lines, while the other lines keep their parse tree
+	graph, err = ParseCode("a: b + 1\nb: a * 2\nc: 5\nd: d + c")
+	if err == nil {
+		t.Fatal("The definitions should be cyclical")
+	}
+	graph.markCyclicalDependencies()
+
+	lines = graph.AstJSON()
+	for _, i := range []int{0, 1, 3} {
+		if lines[i].Ast != nil || !strings.HasPrefix(lines[i].Error, "Cyclical definitions detected") {
+			t.Errorf("Line %d should report the cycle, got %+v instead", i+1, lines[i])
+		}
+	}
+	if lines[2].Ast == nil || lines[2].Error != "" {
+		t.Errorf("The third line should keep its parse tree, got %+v instead", lines[2])
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	LoadUnitAliases()
+
+	from, err := ParseUnit("km/hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := ParseUnit("m / s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := ConvertCompositeUnits(36, from, to)
+	if err != nil || math.Abs(value-10) > 1e-9 {
+		t.Errorf("36 km/hour should be 10 m/s, got %f (%v) instead", value, err)
+	}
+
+	if _, err := ParseUnit("m] 5 ["); err == nil {
+		t.Errorf("Expressions should not be parsed as units")
+	}
+}
+
+func TestCurrencyRates(t *testing.T) {
+	LoadUnitAliases()
+
+	results := []float64{}
+	for _, rate := range []float64{1.25, 2} {
+		graph := ExecutionGraph{SourceCode: "(10 [usd]) [eur]", CurrencyRates: map[string]float64{"usd": rate}}
+		if err := graph.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		graph.Execute()
+
+		results = append(results, graph.Lines[0].Value)
+	}
+
+	if math.Abs(results[0]-8) > 1e-9 || math.Abs(results[1]-5) > 1e-9 {
+		t.Errorf("10 usd should be 8 and 5 eur with the two rates, got %v instead", results)
+	}
+
+	// the units parsed by the graph, e.g. by /convert, apply the rates too
+	graph := ExecutionGraph{CurrencyRates: map[string]float64{"usd": 1.25}}
+	from, _ := graph.ParseUnit("usd")
+	to, _ := graph.ParseUnit("eur")
+
+	if value, err := ConvertCompositeUnits(10, from, to); err != nil || math.Abs(value-8) > 1e-9 {
+		t.Errorf("10 usd should be 8 eur with the rate of the graph, got %f (%v) instead", value, err)
+	}
+
+	if UnitTable["usd"].ConversionFactor != 0.84 {
+		t.Errorf("The rates of a graph should not change the UnitTable")
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	LoadUnitAliases()
+	graph := ExecutionGraph{}
+
+	inputs := []string{"a: 3 [m]", "a: a * 2", "", "b: a + ans", "1 + $", "line2 / 2"}
+	for _, input := range inputs {
+		graph.AppendLine(input)
+	}
+
+	if graph.Lines[1].HasError() || graph.Lines[1].Value != 6 {
+		t.Errorf("Redefining a should give 6 m, got %f (%v) instead", graph.Lines[1].Value, graph.Lines[1].Error)
+	}
+
+	if graph.Lines[3].HasError() || graph.Lines[3].Value != 12 || graph.Lines[3].Unit.String() != "m" {
+		t.Errorf("b should be 12 m, got %f %s (%v) instead", graph.Lines[3].Value, graph.Lines[3].Unit, graph.Lines[3].Error)
+	}
+
+	if !graph.Lines[4].HasError() {
+		t.Errorf("An invalid line should have an error")
+	}
+
+	if graph.Lines[5].HasError() || graph.Lines[5].Value != 3 {
+		t.Errorf("line2 / 2 should be 3, got %f (%v) instead", graph.Lines[5].Value, graph.Lines[5].Error)
+	}
+
+	if graph.Lines[0].Value != 3 {
+		t.Errorf("The previous lines should not be executed again, got %f instead", graph.Lines[0].Value)
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	graph := ExecutionGraph{SourceCode: "1/3\n2", Precision: 3}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "0.333\n2.00" {
+		t.Errorf("The results should have 3 significant digits, got %q instead", result)
+	}
+
+	if graph.Lines[0].Value != float64(1)/3 {
+		t.Errorf("The precision should not change the stored value")
+	}
+
+	graph.Precision = 0
+	if result := graph.ExecutionResult(); result != "0.333333\n2" {
+		t.Errorf("The default formatting should be kept, got %q instead", result)
+	}
+
+	// the digits are counted from the first significant one, also when the rounding adds a digit
+	graph = ExecutionGraph{SourceCode: "9,96\n12345\n0,0012345", Precision: 2}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "10\n12000\n0.0012" {
+		t.Errorf("The results should have 2 significant digits, got %q instead", result)
+	}
+}
+
+func TestScalePrefixes(t *testing.T) {
+	LoadUnitAliases()
+	graph := ExecutionGraph{SourceCode: "0,0000034 [m]\n(2 [m]) [cm]", ScalePrefixes: true}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "3.4 μm\n200 cm" {
+		t.Errorf("Only the first result should be scaled, got %q instead", result)
+	}
+}
+
+func TestSimplifyUnitsKeepsWrittenUnits(t *testing.T) {
+	LoadUnitAliases()
+	graph := ExecutionGraph{SourceCode: "(10 [N]) * (2 [m])\n5 [N m]\n(10 [N]) * (2 [m]) [N m]\nt: 5 [N m]\nt * 2", SimplifyUnits: true}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "20 J\n5 N m\n20 N m\nt: 5 N m\n10 J" {
+		t.Errorf("Only the lines not ending with a unit should be simplified, got %q instead", result)
+	}
+}
+
+func TestThousandsSeparators(t *testing.T) {
+	graph := ExecutionGraph{SourceCode: "1234567,5\n-1234\n12", ThousandsSeparators: true, Precision: 5}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "1.234.600\n-1.234,0\n12,000" {
+		t.Errorf("The results should be grouped in thousands, got %q instead", result)
+	}
+
+	graph.DecimalSeparator = "."
+	if result := graph.ExecutionResult(); result != "1,234,600\n-1,234.0\n12.000" {
+		t.Errorf("The results should use the separators of the locale, got %q instead", result)
+	}
+
+	if graph.Lines[0].Value != 1234567.5 {
+		t.Errorf("The separators should not change the stored value")
+	}
+
+	graph = ExecutionGraph{SourceCode: "1/0\n-1/0", ThousandsSeparators: true, AllowInfinity: true}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "+Inf\n-Inf" {
+		t.Errorf("The infinities should not be grouped, got %q instead", result)
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	line := executeSource("5 / (2 - 2)")
+	if !line.HasError() || line.Error.Error() != "Division by zero" {
+		t.Errorf("5 / (2 - 2) should fail with division by zero, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	graph := ExecutionGraph{SourceCode: "5 / 0", AllowInfinity: true}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if graph.Lines[0].HasError() || !math.IsInf(graph.Lines[0].Value, 1) {
+		t.Errorf("5 / 0 should be +Inf when infinities are allowed, got %f (%v) instead", graph.Lines[0].Value, graph.Lines[0].Error)
+	}
+}
+
+func TestNonFiniteResults(t *testing.T) {
+	if line := executeSource("sqrt(-1)"); !line.HasError() {
+		t.Errorf("sqrt(-1) should fail, got %f instead", line.Value)
+	}
+
+	if line := executeSource("ln 0"); !line.HasError() {
+		t.Errorf("ln 0 should fail, got %f instead", line.Value)
+	}
+
+	graph := ExecutionGraph{SourceCode: "ln 0\n0 / 0", AllowInfinity: true}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if graph.Lines[0].HasError() || !math.IsInf(graph.Lines[0].Value, -1) {
+		t.Errorf("ln 0 should be -Inf when infinities are allowed, got %f (%v) instead", graph.Lines[0].Value, graph.Lines[0].Error)
+	}
+
+	if !graph.Lines[1].HasError() {
+		t.Errorf("0 / 0 should fail even when infinities are allowed, got %f instead", graph.Lines[1].Value)
+	}
+}
+
+func TestUnitExponentChain(t *testing.T) {
+	line := executeSource("5 [m^2^3]")
+	if !line.HasError() || !strings.Contains(line.Error.Error(), "Invalid unit exponent chain") {
+		t.Errorf("[m^2^3] should fail with an invalid exponent chain, got %s (%v) instead", line.Unit, line.Error)
+	}
+
+	line = executeSource("5 [m^2/s^2]")
+	if line.HasError() || line.Unit.String() != "m^2 / s^2" {
+		t.Errorf("[m^2/s^2] should be parsed, got %s (%v) instead", line.Unit, line.Error)
+	}
+}
+
+func TestUndefinedVariable(t *testing.T) {
+	graph, err := ParseCode("a: 2\na + foo * 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syntaxError, ok := graph.Lines[1].Error.(SyntaxError)
+	if !ok || syntaxError.Message != "Undefined variable 'foo'" || syntaxError.Column != 5 {
+		t.Errorf("foo should be reported as undefined at column 5, got %v instead", graph.Lines[1].Error)
+	}
+}
+
+func TestFunctionWithoutParentheses(t *testing.T) {
+	line := executeSource("sqrt 16")
+	if line.HasError() || line.Value != 4 {
+		t.Errorf("sqrt 16 should be 4, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2 sqrt 16")
+	if line.HasError() || line.Value != 8 {
+		t.Errorf("2 sqrt 16 should be 8, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	for _, source := range []string{"sqrt 4 + 5", "sin pi/2", "sqrt -4", "2 * sqrt 4 ^ 2"} {
+		if line := executeSource(source); !line.HasError() {
+			t.Errorf("%s should require parentheses, got %f instead", source, line.Value)
+		}
+	}
+
+	line = executeSource("sqrt(4 + 5)")
+	if line.HasError() || line.Value != 3 {
+		t.Errorf("sqrt(4 + 5) should be 3, got %f (%v) instead", line.Value, line.Error)
+	}
+}
+
+func TestStatementsOnOneLine(t *testing.T) {
+	graph, err := ParseCode("c: b + 1; a: 3; b: a*2\n\nline1 * 2; ans + 1;  # comment\n1 +; x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	expected := "c: 7; a: 3; b: 6\nX\n12; 13\n! Cannot end expression with operation; ! Undefined variable 'x' (line 4, column 6)"
+	if result := graph.ExecutionResult(); result != expected {
+		t.Errorf("The result should be\n%s\ngot\n%s\ninstead", expected, result)
+	}
+
+	if len(graph.Lines) != 8 || graph.Lines[5].SourceLine != 2 {
+		t.Errorf("The code should be split in 8 statements, got %d instead", len(graph.Lines))
+	}
+
+	tokenization := graph.TokenizationJSON()
+	if len(tokenization) != 4 || tokenization[0].Tokens[8].Kind != "terminator" || tokenization[0].Tokens[8].Start != 8 {
+		t.Errorf("The tokens should be grouped by line of code, got %+v instead", tokenization)
+	}
+}
+
+func TestEqualsDefinition(t *testing.T) {
+	graph, err := ParseCode("x = 5\ny: x * 2\nunit furlong = 201,168 [m]\nz = (1 [furlong]) [m]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "x: 5\ny: 10\n201.168 m\nz: 201.168 m" {
+		t.Errorf("= should define variables, got %q instead", result)
+	}
+}
+
+func TestDoubleStarExponentiation(t *testing.T) {
+	line := executeSource("2 ** 3 * 2")
+	if line.HasError() || line.Value != 16 {
+		t.Errorf("2 ** 3 * 2 should be 16, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2**3**2")
+	if line.HasError() || line.Value != executeSource("2^3^2").Value {
+		t.Errorf("2**3**2 should be the same as 2^3^2, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("(3 [m])**2")
+	if line.HasError() || line.Value != 9 || line.Unit.String() != "m^2" {
+		t.Errorf("(3 [m])**2 should be 9 m^2, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+}
+
+func TestScientificDisplay(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, err := ParseCode("h\nk_B\n10^300\n4,9999999998\n123456789,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	expected := "6.62607015e-34 J s\n1.380649e-23 J / K\n1e+300\n5\n123456789.5"
+	if result := graph.ExecutionResult(); result != expected {
+		t.Errorf("The results should be\n%s\ngot\n%s\ninstead", expected, result)
+	}
+
+	graph.Precision = 3
+	graph.ThousandsSeparators = true
+	expected = "6,63e-34 J s\n1,38e-23 J / K\n1,00e+300\n5,00\n123.000.000"
+	if result := graph.ExecutionResult(); result != expected {
+		t.Errorf("The results should be\n%s\ngot\n%s\ninstead", expected, result)
+	}
+}
+
+func TestTrimmedDisplay(t *testing.T) {
+	graph, err := ParseCode("10/2\n1/3\n0,1 + 0,2\n-0,0000000001\n(2,5 [m]) * 4\n0 * -1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.ExecutionResult(); result != "5\n0.333333\n0.3\n-1e-10\n10 m\n0" {
+		t.Errorf("The results should be displayed without trailing zeros, got %q instead", result)
+	}
+
+	if graph.Lines[2].Value == 0.3 {
+		t.Errorf("The display should not change the stored value")
+	}
+}
+
+func TestSumAggregate(t *testing.T) {
+	graph, err := ParseCode("3 [m]\n\n2 [km]\n5 [cm]\nsum(line1, line4)\n4 [s]\nsum(line1, line6)\nsum(line4, line1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.LineResult(&graph.Lines[4]); result != "2003.05 m" {
+		t.Errorf("sum should add the lines in the unit of the first one, got %q instead", result)
+	}
+	if !graph.Lines[6].HasError() {
+		t.Errorf("sum of incompatible units should be an error")
+	}
+	if !graph.Lines[7].HasError() {
+		t.Errorf("sum of a reversed range should be an error")
+	}
+
+	if line := executeSource("sum(1, 2)"); !line.HasError() {
+		t.Errorf("sum should only accept line references")
+	}
+}
+
+func TestAvgAggregate(t *testing.T) {
+	graph, err := ParseCode("3 [m]\n\n2 [km]\n5 [cm]\navg(line1, line4)\n\navg(line6, line6)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if result := graph.LineResult(&graph.Lines[4]); result != "667.683333 m" {
+		t.Errorf("avg should skip the empty lines, got %q instead", result)
+	}
+	if !graph.Lines[6].HasError() {
+		t.Errorf("avg of empty lines should be an error")
+	}
+}
+
+func TestUpdateSource(t *testing.T) {
+	graph, err := ParseCode("a: 2\nb: a * 3\nc: 10\nb + c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	updates := []string{"a: 4\nb: a * 3\nc: 1\nb + c", "a: 4\nb: a * 3\nb + 1", "a: 4\nb: a * 3\nb + 1\nans * 2"}
+	for _, sourceCode := range updates {
+		if err := graph.UpdateSource(sourceCode); err != nil {
+			t.Fatal(err)
+		}
+
+		expected, _ := ParseCode(sourceCode)
+		expected.Execute()
+
+		if result := graph.ExecutionResult(); result != expected.ExecutionResult() {
+			t.Errorf("Updating the source to %q should give %q, got %q instead", sourceCode, expected.ExecutionResult(), result)
+		}
+	}
+}
+
+func TestUpdateLine(t *testing.T) {
+	graph, err := ParseCode("a: 2\nb: a * 3\nc: 10\nb + c\nd: 1/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	executed, err := graph.UpdateLine(0, "a: 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(executed) != 4 || containsInt(executed, 2) {
+		t.Errorf("Only the changed line and its dependents should be executed, got %v instead", executed)
+	}
+	if result := graph.ExecutionResult(); result != "a: 4\nb: 12\nc: 10\n22\nd: 0.25" {
+		t.Errorf("The dependents should be updated, got %q instead", result)
+	}
+
+	graph.UpdateLine(0, "a: 0")
+	graph.UpdateLine(0, "a: 5")
+	if result := graph.LineResult(&graph.Lines[4]); result != "d: 0.2" {
+		t.Errorf("The execution errors should be cleared, got %q instead", result)
+	}
+
+	// renaming a variable executes the whole code again
+	executed, err = graph.UpdateLine(2, "e: 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(executed) != 5 || !graph.Lines[3].HasError() {
+		t.Errorf("Renaming a variable should parse the code again, got %v instead", executed)
+	}
+
+	if _, err := graph.UpdateLine(0, "a: b"); err == nil {
+		t.Errorf("A cyclical definition should be an error")
+	}
+}
+
+type benchmarkSource struct {
+	name   string
+	source string
+}
+
+// Returns the sources the benchmarks run on: the test.cal fixture and a large generated file
+func benchmarkSources(b *testing.B) []benchmarkSource {
+	LoadUnitAliases()
+
+	fixture, err := ioutil.ReadFile("./test.cal")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	generated := []string{}
+	for i := 0; i < 500; i++ {
+		generated = append(generated,
+			fmt.Sprintf("x%d: (%d,5 [km]) + (250 [m]) # distance %d", i, i+1, i),
+			fmt.Sprintf("sqrt(x%d * x%d) / (2 [hours]) in [m/s]", i, i),
+			"",
+			"ans * 1.000 + 0xFF - 2^3",
+		)
+	}
+
+	return []benchmarkSource{{"fixture", string(fixture)}, {"generated", strings.Join(generated, "\n")}}
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	for _, benchmark := range benchmarkSources(b) {
+		source := benchmark.source
+
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				graph := ExecutionGraph{SourceCode: source}
+				graph.Tokenize(false)
+			}
+		})
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, benchmark := range benchmarkSources(b) {
+		source := benchmark.source
+
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseCode(source); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExecute(b *testing.B) {
+	for _, benchmark := range benchmarkSources(b) {
+		source := benchmark.source
+
+		b.Run(benchmark.name, func(b *testing.B) {
+			graph, err := ParseCode(source)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				graph.Execute()
+			}
+		})
+	}
+}
+
+// Long numbers, names and strings are where building the values one character at a time was quadratic
+func BenchmarkTokenizeLongTokens(b *testing.B) {
+	source := strings.Repeat("1", 5000) + " * " + strings.Repeat("x", 5000) + " + ascii(\"" + strings.Repeat("G", 5000) + "\")"
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := tokenizer(source, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnicodeSource(t *testing.T) {
+	line := executeSource("(5 [°C]) [°F]")
+	if line.HasError() || line.Value != 41 {
+		t.Errorf("(5 [°C]) [°F] should be 41, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("(20 [µg]) + (1 [mg]) [mg]")
+	if line.HasError() || math.Abs(line.Value-1.02) > 1e-9 {
+		t.Errorf("µg should be usable in the source, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	// the currency symbols give their unit to the number they precede or follow
+	for _, source := range []string{"£10", "10 £", "10 [£]"} {
+		line = executeSource(source + " in [€]")
+		if line.HasError() || math.Abs(line.Value-11.7) > 1e-9 || line.Unit.String() != "€" {
+			t.Errorf("%s in [€] should be 11,7 €, got %f %s (%v) instead", source, line.Value, line.Unit, line.Error)
+		}
+	}
+
+	line = executeSource("¥100 + $10 [€]")
+	if line.HasError() || math.Abs(line.Value-21.4) > 1e-9 {
+		t.Errorf("¥100 + $10 [€] should be 21,4 €, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("2 * €")
+	if line.Error == nil || !strings.Contains(line.Error.Error(), "must precede or follow a number") {
+		t.Errorf("A currency symbol with no number should be an error, got %v instead", line.Error)
+	}
+
+	// positions count characters, not bytes
+	line = executeSource("\"é\" + @")
+	if err, ok := line.Error.(SyntaxError); !ok || err.Column != 7 {
+		t.Errorf("The column should count characters, got %v instead", line.Error)
+	}
+}
+
+func TestLaTeX(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, err := ParseCode("x: 2\nsqrt(x)/2 + (x - 1) * 3^(x+1)\n\n(5 [km/hour]) in [m/s]; -x!\nundefined")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		`x = 2`,
+		`\frac{\sqrt{x}}{2} + \left(x - 1\right) \cdot {3}^{x + 1}`,
+		``,
+		`5\,\frac{\mathrm{km}}{\mathrm{hours}} \rightarrow \frac{\mathrm{m}}{\mathrm{s}}; -x!`,
+		`% Undefined variable 'undefined' (line 5, column 1)`,
+	}, "\n")
+
+	if result := graph.LaTeX(); result != expected {
+		t.Errorf("The LaTeX should be\n%s\ngot\n%s\ninstead", expected, result)
+	}
+}
+
+func TestPlot(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, err := ParseCode("a: 2\nf: a * x^2 + 1\ng: sqrt(x)\nx: 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	points, err := graph.Plot("f", "x", -1, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PlotPoint{{-1, 3}, {-0.5, 1.5}, {0, 1}, {0.5, 1.5}, {1, 3}}
+	if len(points) != len(expected) {
+		t.Fatalf("The plot should have %d points, got %v instead", len(expected), points)
+	}
+	for i := range expected {
+		if points[i] != expected[i] {
+			t.Errorf("Point %d should be %v, got %v instead", i, expected[i], points[i])
+		}
+	}
+
+	if graph.Lines[1].Value != 19 {
+		t.Errorf("The value of x in the code should be restored, got f = %f instead", graph.Lines[1].Value)
+	}
+
+	// the points where the function has an error are skipped
+	points, _ = graph.Plot("g", "x", -1, 1, 2)
+	if len(points) != 2 || points[0].X != 0 {
+		t.Errorf("The points with an error should be skipped, got %v instead", points)
+	}
+
+	if _, err := graph.Plot("f", "x", 0, 1, MaxPlotSteps+1); err == nil {
+		t.Errorf("Plotting more than MaxPlotSteps steps should fail")
+	}
+
+	if _, err := graph.Plot("h", "x", 0, 1, 10); err == nil {
+		t.Errorf("Plotting an undefined variable should be an error")
+	}
+}
+
+func TestCheckUnits(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, err := ParseCode("(5 [m]) + (3 [s])\nx: 2 [m]\nx + (1 [kg])\ny: (1 [m])^n + (1 [s])\nn: 2\n(2 [m])^2 + (1 [m^2])\nsqrt(4 [m^2]) [cm]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if graph.CheckUnits() {
+		t.Fatalf("The check should fail")
+	}
+
+	for _, i := range []int{0, 2} {
+		if line := graph.Lines[i]; line.Error == nil || line.Error.Error() != "Units are not compatible" {
+			t.Errorf("Line %d should have incompatible units, got %v instead", i+1, line.Error)
+		}
+	}
+	for _, i := range []int{1, 3, 4, 5, 6} {
+		if line := graph.Lines[i]; line.HasError() || line.Value != 0 {
+			t.Errorf("Line %d should be neither failed nor executed, got %f (%v) instead", i+1, line.Value, line.Error)
+		}
+	}
+
+	expected := []string{"Units are not compatible (line 1)", "Units are not compatible (line 3)"}
+	if messages := graph.ErrorMessages(); strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("The errors should be %v, got %v instead", expected, messages)
+	}
+
+	// the unit of y depends on the value of n, so its error is found by the execution
+	graph.Execute()
+	if line := graph.Lines[3]; !line.HasError() {
+		t.Errorf("Line 4 should fail when executed")
+	}
+	if line := graph.Lines[6]; line.HasError() || line.Value != 200 {
+		t.Errorf("Line 7 should be 200 cm, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	graph, _ = ParseCode("speed: 5 [m/s]\nspeed * (2 [s]) + (1 [km])\nsum(line1, line1) [km/h]")
+	if !graph.CheckUnits() {
+		t.Errorf("Compatible units should pass the check, got %v instead", graph.ErrorMessages())
+	}
+}
+
+func TestUnitErrorsBeforeExecution(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, err := ParseCode("(5 [m]) + (3 [s])\n2 + 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if graph.Lines[0].HasError() {
+		t.Errorf("Parsing should not check the units, got %v", graph.Lines[0].Error)
+	}
+
+	graph.CheckUnits()
+	if line := graph.Lines[0]; line.Error == nil || line.Error.Error() != "Units are not compatible" {
+		t.Errorf("The incompatible units should be found before the execution, got %v instead", line.Error)
+	}
+	if line := graph.Lines[1]; line.HasError() || line.Value != 0 {
+		t.Errorf("The second line should not be executed, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	if result := graph.ColorizedHTML(); !strings.Contains(result, `<div class="calc-line" data-line="1"><span class="calc-line-error">`) {
+		t.Errorf("The colorized HTML should mark the unit error, got %s instead", result)
+	}
+
+	graph.Execute()
+	if line := graph.Lines[0]; line.Error == nil || line.Error.Error() != "Units are not compatible" {
+		t.Errorf("The error should be kept by the execution, got %v instead", line.Error)
+	}
+
+	graph, err = ParseCode("1/0 + (3 [s])\nx: (2 [m]) - (1 [m])\nx + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graph.Execute()
+	if line := graph.Lines[0]; line.Error == nil || line.Error.Error() != "Units are not compatible" {
+		t.Errorf("The execution should check the units before computing the values, got %v instead", line.Error)
+	}
+	if line := graph.Lines[2]; line.Error == nil || line.Error.Error() != "Units are not compatible" {
+		t.Errorf("The execution should check the units of the referred lines, got %v instead", line.Error)
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	graph, err := ParseCode("1 + 1\n2 + 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := graph.ExecuteContext(ctx); err != context.Canceled || graph.Lines[0].Value != 0 {
+		t.Errorf("The execution should stop when the context is canceled, got %v instead", err)
+	}
+
+	if err := graph.ExecuteContext(context.Background()); err != nil || graph.ExecutionResult() != "2\n4" {
+		t.Errorf("The execution should complete, got %q (%v) instead", graph.ExecutionResult(), err)
+	}
+}
+
+// checksContext is done after the given number of checks, to interrupt the execution at a known point
+type checksContext struct {
+	context.Context
+	checks int
+}
+
+func (ctx *checksContext) Err() error {
+	if ctx.checks <= 0 {
+		return context.Canceled
+	}
+
+	ctx.checks--
+	return nil
+}
+
+func TestExecuteContextInterruptsLine(t *testing.T) {
+	graph, err := ParseCode("x: 1\n2\n3\ny: sum(line1, line3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one check before each line, then the context is done while adding up the range
+	if err := graph.ExecuteContext(&checksContext{context.Background(), 5}); err != context.Canceled {
+		t.Errorf("The execution should be interrupted, got %v instead", err)
+	}
+	if graph.Lines[2].Value != 3 || graph.Lines[3].Error != context.Canceled {
+		t.Errorf("The sum should be interrupted after executing the other lines, got %q instead", graph.ExecutionResult())
+	}
+
+	if err := graph.ExecuteContext(context.Background()); err != nil || graph.ExecutionResult() != "x: 1\n2\n3\ny: 6" {
+		t.Errorf("The graph should be usable after the interruption, got %q (%v) instead", graph.ExecutionResult(), err)
+	}
+
+	points, err := graph.PlotContext(&checksContext{context.Background(), 3}, "y", "x", 0, 10, 10)
+	if err != context.Canceled || points != nil {
+		t.Errorf("The plot should be interrupted, got %v (%v) instead", points, err)
+	}
+	if result := graph.ExecutionResult(); result != "x: 1\n2\n3\ny: 6" {
+		t.Errorf("The lines should be restored after the interrupted plot, got %q instead", result)
+	}
+}
+
+func TestColorizedErrors(t *testing.T) {
+	graph, _ := ParseCode("1 + 2\nx @ 2; 3 + y")
+
+	expected := `<div class="calc-line" data-line="1"><span class="calc-token-number" data-start="0" data-end="1">1</span>` +
+		`<span class="calc-token-whitespace" data-start="1" data-end="2"> </span><span class="calc-token-operator" data-start="2" data-end="3">+</span>` +
+		`<span class="calc-token-whitespace" data-start="3" data-end="4"> </span><span class="calc-token-number" data-start="4" data-end="5">2</span></div>` +
+		`<div class="calc-line" data-line="2"><span class="calc-line-error"><span class="calc-token-literal" data-start="0" data-end="1">x</span>` +
+		`<span class="calc-token-whitespace" data-start="1" data-end="2"> </span><span class="calc-token-unknown calc-token-error" data-start="2" data-end="3">@</span>` +
+		`<span class="calc-token-whitespace" data-start="3" data-end="4"> </span><span class="calc-token-number" data-start="4" data-end="5">2</span>` +
+		`<span class="calc-token-terminator" data-start="5" data-end="6">;</span><span class="calc-token-whitespace" data-start="6" data-end="7"> </span>` +
+		`<span class="calc-token-number" data-start="7" data-end="8">3</span><span class="calc-token-whitespace" data-start="8" data-end="9"> </span>` +
+		`<span class="calc-token-operator" data-start="9" data-end="10">+</span><span class="calc-token-whitespace" data-start="10" data-end="11"> </span>` +
+		`<span class="calc-token-literal" data-start="11" data-end="12">y</span></span></div>`
+
+	if result := graph.ColorizedHTML(); result != expected {
+		t.Errorf("The colorized HTML should be\n%s\ngot\n%s\ninstead", expected, result)
+	}
+
+	graph, _ = ParseCode("2; 3 + y")
+	if result := graph.ColorizedHTML(); !strings.Contains(result, `<span class="calc-line-error"><span class="calc-token-whitespace" data-start="2" data-end="3"> </span><span class="calc-token-number" data-start="3" data-end="4">3</span>`) ||
+		!strings.Contains(result, `<span class="calc-token-literal calc-token-error" data-start="7" data-end="8">y</span>`) {
+		t.Errorf("Only the statement with the error should be marked, got %s instead", result)
+	}
+}
+
+func TestColorizedCSS(t *testing.T) {
+	for theme := range ColorizeThemes {
+		css, err := ColorizedCSS(theme)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, class := range []string{".calc-token-number ", ".calc-token-literal-unit", ".calc-token-comment ", ".calc-token-error "} {
+			if !strings.Contains(css, class) {
+				t.Errorf("The %s theme should style %s, got\n%s", theme, class, css)
+			}
+		}
+	}
+
+	if _, err := ColorizedCSS("sepia"); err == nil {
+		t.Errorf("An unknown theme should be an error")
+	}
+}
+
+func TestColorizedLines(t *testing.T) {
+	graph := ExecutionGraph{SourceCode: "1\n\n# note"}
+	graph.Tokenize(true)
+
+	expected := `<div class="calc-line" data-line="1"><span class="calc-token-number" data-start="0" data-end="1">1</span></div>` +
+		`<div class="calc-line" data-line="2"></div>` +
+		`<div class="calc-line" data-line="3"><span class="calc-token-comment" data-start="0" data-end="6"># note</span></div>`
+
+	if result := graph.ColorizedHTML(); result != expected {
+		t.Errorf("Each line should be wrapped in its own element, got %s instead", result)
+	}
+}
+
+func TestColorizedEscaping(t *testing.T) {
+	graph := ExecutionGraph{SourceCode: "ascii(\"<\") < 2 # <script>&"}
+	graph.Tokenize(true)
+	result := graph.ColorizedHTML()
+
+	if strings.Contains(result, "<script>") || !strings.Contains(result, "# &lt;script&gt;&amp;") ||
+		!strings.Contains(result, `<span class="calc-token-unknown" data-start="11" data-end="12">&lt;</span>`) || !strings.Contains(result, `<span class="calc-token-string" data-start="6" data-end="9">&lt;</span>`) {
+		t.Errorf("The token values should be escaped, got %s instead", result)
+	}
+}
+
+func TestColorizedCommentAfterUnbalancedBracket(t *testing.T) {
+	LoadUnitAliases()
+
+	graph, _ := ParseCode("2 [m # result is 5 [m]\n3 [m]")
+	result := graph.ColorizedHTML()
+
+	if !strings.Contains(result, `<span class="calc-token-literal-unit" data-start="3" data-end="4">m</span><span class="calc-token-whitespace-unit" data-start="4" data-end="5"> </span>`+
+		`<span class="calc-token-comment" data-start="5" data-end="22"># result is 5 [m]</span>`) {
+		t.Errorf("The comment should not be tagged as part of the unit, got %s instead", result)
+	}
+
+	if !strings.Contains(result, `<div class="calc-line" data-line="2"><span class="calc-token-number" data-start="0" data-end="1">3</span>`+
+		`<span class="calc-token-whitespace" data-start="1" data-end="2"> </span><span class="calc-token-bracket-unit" data-start="2" data-end="3">[</span>`) {
+		t.Errorf("The unit tag should not leak into the next line, got %s instead", result)
+	}
+}
+
+func TestPercentOf(t *testing.T) {
+	line := executeSource("15% of 200")
+	if line.HasError() || math.Abs(line.Value-30) > 1e-9 {
+		t.Errorf("15%% of 200 should be 30, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("10% of (50 [eur]) + (1 [eur])")
+	if line.HasError() || math.Abs(line.Value-6) > 1e-9 || line.Unit.String() != "€" {
+		t.Errorf("10%% of (50 [eur]) + (1 [eur]) should be 6 €, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	line = executeSource("percentchange(200, 250)")
+	if line.HasError() || line.Value != 0.25 {
+		t.Errorf("percentchange(200, 250) should be 0,25, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	line = executeSource("percentchange(1 [km], 500 [m])")
+	if line.HasError() || line.Value != -0.5 || !line.Unit.IsEmpty() {
+		t.Errorf("percentchange(1 [km], 500 [m]) should be -0,5, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	if line := executeSource("percentchange(0, 1)"); !line.HasError() {
+		t.Errorf("percentchange from 0 should be an error")
+	}
+}
+
+func TestPercentagesWithUnits(t *testing.T) {
+	for _, source := range []string{"200 [kg] * 10%", "10% * (200 [kg])", "10% of (200 [kg])"} {
+		line := executeSource(source)
+		if line.HasError() || math.Abs(line.Value-20) > 1e-9 || line.Unit.String() != "kg" {
+			t.Errorf("%s should be 20 kg, got %f %s (%v) instead", source, line.Value, line.Unit, line.Error)
+		}
+	}
+
+	line := executeSource("50% [m]")
+	if line.HasError() || line.Value != 0.5 || line.Unit.String() != "m" {
+		t.Errorf("50%% [m] should be 0,5 m, got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	// percentages are dimensionless, so they cannot be added to a quantity with a unit
+	if line := executeSource("(200 [kg]) + 10%"); !line.HasError() {
+		t.Errorf("A percentage should not be added to a quantity with a unit")
+	}
+
+	line = executeSource("1.000%")
+	if line.HasError() || line.Value != 10 {
+		t.Errorf("1.000%% should be 10, got %f (%v) instead", line.Value, line.Error)
+	}
+
+	if line := executeSource("50%00"); !line.HasError() {
+		t.Errorf("The percent sign should end the number")
+	}
+}
+
+func TestUnitDivisionPrecedence(t *testing.T) {
+	LoadUnitAliases()
+
+	cases := map[string]map[string]float64{
+		"m/s^2":      {"meter": 1, "second": -2},
+		"kg*m/s/A":   {"kilogram": 1, "meter": 1, "second": -1, "ampere": -1},
+		"m/s*kg":     {"meter": 1, "second": -1, "kilogram": 1},
+		"m/s kg":     {"meter": 1, "second": -1, "kilogram": 1},
+		"kg m/(s*A)": {"kilogram": 1, "meter": 1, "second": -1, "ampere": -1},
+		"kg/(m s)^2": {"kilogram": 1, "meter": -2, "second": -2},
+		"1/s":        {"second": -1},
+	}
+
+	for source, expected := range cases {
+		unit, err := ParseUnit(source)
+		if err != nil {
+			t.Errorf("[%s] should be parsed, got %v instead", source, err)
+			continue
+		}
+
+		dimensions := unit.Dimensions()
+		if len(dimensions) != len(expected) {
+			t.Errorf("[%s] should have dimensions %v, got %v instead", source, expected, dimensions)
+			continue
+		}
+		for baseUnit, exp := range expected {
+			if dimensions[baseUnit] != exp {
+				t.Errorf("[%s] should have dimensions %v, got %v instead", source, expected, dimensions)
+				break
+			}
+		}
+	}
+
+	line := executeSource("(6 [N*m]) / (2 [s*A]) [N*m/(s*A)]")
+	if line.HasError() || line.Value != 3 {
+		t.Errorf("(6 [N*m]) / (2 [s*A]) should be 3 N m / (s A), got %f %s (%v) instead", line.Value, line.Unit, line.Error)
+	}
+
+	for _, source := range []string{"m/", "/s", "m//s", "m*/s", "(m/s", "m/s)", "m/()", "", " "} {
+		if _, err := ParseUnit(source); err == nil {
+			t.Errorf("[%s] should not be parsed", source)
+		}
+	}
+}
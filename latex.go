@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the commands of the functions known to LaTeX, the others are typeset with \operatorname
+var latexFunctions = map[string]string{"log": `\log`, "ln": `\ln`, "sin": `\sin`, "cos": `\cos`, "tan": `\tan`}
+
+var latexConstants = map[string]string{
+	"pi": `\pi`, "tau": `\tau`, "phi": `\phi`, "e": "e",
+	"c": "c", "g": "g", "h": "h", "k_B": `k_\mathrm{B}`, "N_A": `N_\mathrm{A}`,
+}
+
+// Escapes the characters with a special meaning in LaTeX
+func escapeLaTeX(text string) string {
+	replacer := strings.NewReplacer(`\`, `\backslash `, "{", `\{`, "}", `\}`, "$", `\$`, "%", `\%`, "_", `\_`, "#", `\#`, "&", `\&`)
+
+	return replacer.Replace(text)
+}
+
+// Returns the node an expression without unit stands for, e.g. the content of parentheses
+func unwrapExpression(ast Ast) Ast {
+	for ast.Kind == "Expression" && ast.Unit.IsEmpty() && len(ast.Params) == 1 {
+		ast = ast.Params[0]
+	}
+
+	return ast
+}
+
+// Returns how tightly a node binds its operands, to decide where parentheses are needed
+func latexPrecedence(ast Ast) int {
+	ast = unwrapExpression(ast)
+
+	switch {
+	case ast.Kind == "Conversion":
+		return 0
+	case ast.Kind == "Operator" && (ast.Value == "+" || ast.Value == "-"):
+		return 1
+	case ast.Kind == "Operator" && (ast.Value == "*" || ast.Value == "/"), ast.Kind == "Expression":
+		return 2
+	case ast.Kind == "Operator" && ast.Value == "^":
+		return 3
+	case ast.Kind == "Operator" && ast.Value == "!":
+		return 4
+	}
+
+	return 5
+}
+
+// Typesets the node, in parentheses if it binds less tightly than the given precedence
+func latexOperand(ast Ast, precedence int) string {
+	if latexPrecedence(ast) < precedence {
+		return `\left(` + ast.LaTeX() + `\right)`
+	}
+
+	return ast.LaTeX()
+}
+
+// Typesets a list of arguments in parentheses
+func latexArguments(params []Ast) string {
+	args := []string{}
+	for _, param := range params {
+		args = append(args, param.LaTeX())
+	}
+
+	return `\left(` + strings.Join(args, ", ") + `\right)`
+}
+
+// LaTeX typesets the Ast as a LaTeX formula, e.g. `\frac{\sqrt{x}}{2}\,\mathrm{m}`
+func (ast Ast) LaTeX() string {
+	switch ast.Kind {
+	case "NumberLiteral":
+		// the braces avoid the space LaTeX adds after a comma
+		return strings.ReplaceAll(escapeLaTeX(ast.Value), ",", "{,}")
+	case "String":
+		return `\text{"` + escapeLaTeX(ast.Value) + `"}`
+	case "Constant":
+		return latexConstants[ast.Value]
+	case "Variable":
+		if len([]rune(ast.Value)) == 1 {
+			return escapeLaTeX(ast.Value)
+		}
+
+		return `\mathit{` + escapeLaTeX(ast.Value) + "}"
+	case "PreviousResult":
+		return `\mathrm{ans}`
+	case "LineReference":
+		line, _ := strconv.Atoi(ast.Value)
+
+		return fmt.Sprintf(`\mathrm{line}_{%d}`, line+1)
+	case "Aggregate":
+		first, last := ast.Params[0], ast.Params[len(ast.Params)-1]
+		bounds := []Ast{first, last}
+		if len(ast.Params) > 2 {
+			bounds = []Ast{first, {Kind: "Ellipsis"}, last}
+		}
+
+		return `\operatorname{` + ast.Value + "}" + latexArguments(bounds)
+	case "Ellipsis":
+		return `\ldots`
+	case "Function":
+		switch ast.Value {
+		case "sqrt":
+			return `\sqrt{` + ast.Params[0].LaTeX() + "}"
+		case "abs":
+			return `\left|` + ast.Params[0].LaTeX() + `\right|`
+		case "factorial":
+			return latexOperand(ast.Params[0], 5) + "!"
+		}
+
+		if command, ok := latexFunctions[ast.Value]; ok {
+			return command + latexArguments(ast.Params)
+		}
+
+		return `\operatorname{` + escapeLaTeX(ast.Value) + "}" + latexArguments(ast.Params)
+	case "Method":
+		return `\operatorname{` + escapeLaTeX(ast.Value) + "}" + latexArguments(ast.Params)
+	case "Conversion":
+		return ast.Params[0].LaTeX() + ` \rightarrow ` + ast.Unit.LaTeX()
+	case "Expression":
+		// an empty expression, e.g. () or a line with just a unit, is typeset as its unit alone
+		if len(ast.Params) == 0 {
+			return ast.Unit.LaTeX()
+		} else if ast.Unit.IsEmpty() {
+			return ast.Params[0].LaTeX()
+		}
+
+		return latexOperand(ast.Params[0], 5) + `\,` + ast.Unit.LaTeX()
+	case "Operator":
+		left := ast.Params[0]
+
+		switch ast.Value {
+		case "+":
+			return latexOperand(left, 1) + " + " + latexOperand(ast.Params[1], 1)
+		case "-":
+			// the negation -x is parsed as 0 - x
+			if left.Kind == "NumberLiteral" && left.Value == "0" {
+				return "-" + latexOperand(ast.Params[1], 2)
+			}
+
+			return latexOperand(left, 1) + " - " + latexOperand(ast.Params[1], 2)
+		case "*":
+			return latexOperand(left, 2) + ` \cdot ` + latexOperand(ast.Params[1], 2)
+		case "/":
+			return `\frac{` + left.LaTeX() + "}{" + ast.Params[1].LaTeX() + "}"
+		case "^":
+			return "{" + latexOperand(left, 4) + "}^{" + ast.Params[1].LaTeX() + "}"
+		case "!":
+			return latexOperand(left, 5) + "!"
+		}
+	}
+
+	return escapeLaTeX(ast.Value)
+}
+
+// LaTeX typesets the unit, with the units with a negative exponent in the denominator, e.g. `\frac{\mathrm{km}}{\mathrm{h}}`
+func (cu CompositeUnit) LaTeX() string {
+	cu.Sort()
+	numerator, denominator := []string{}, []string{}
+
+	for _, factor := range cu.UnitsList {
+		exp := factor.Exponent
+		if exp < 0 {
+			exp = -exp
+		}
+
+		unit := `\mathrm{` + escapeLaTeX(factor.Unit.String()) + "}"
+		if exp != 1 {
+			unit += "^{" + strconv.FormatFloat(exp, 'f', -1, 32) + "}"
+		}
+
+		if factor.Exponent < 0 {
+			denominator = append(denominator, unit)
+		} else {
+			numerator = append(numerator, unit)
+		}
+	}
+
+	if len(denominator) == 0 {
+		return strings.Join(numerator, `\,`)
+	}
+	if len(numerator) == 0 {
+		numerator = []string{"1"}
+	}
+
+	return `\frac{` + strings.Join(numerator, `\,`) + "}{" + strings.Join(denominator, `\,`) + "}"
+}
+
+// LaTeX typesets each line of code as a LaTeX formula, separating the statements on the same line with semicolons.
+// Empty lines are left blank and the lines with an error are replaced by a LaTeX comment
+func (graph *ExecutionGraph) LaTeX() string {
+	results := []string{}
+	for i := range graph.Lines {
+		line := &graph.Lines[i]
+		result := ""
+
+		if line.HasError() {
+			result = "% " + line.Error.Error()
+		} else if !line.IsEmpty() {
+			result = line.Ast.LaTeX()
+
+			if tokens := removeNonSemanticTokens(line.RawTokens); isUnitDeclaration(tokens) {
+				result = `1\,\mathrm{` + escapeLaTeX(tokens[1].Value) + "} = " + result
+			} else if line.Name != "" {
+				result = (Ast{Kind: "Variable", Value: line.Name}).LaTeX() + " = " + result
+			}
+		}
+
+		if i > 0 && line.SourceLine == graph.Lines[i-1].SourceLine {
+			results[len(results)-1] += "; " + result
+		} else {
+			results = append(results, result)
+		}
+	}
+
+	return strings.Join(results, "\n")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimitMiddleware rejects with 413 the requests whose body is larger than maxBytes, reading at most maxBytes+1 bytes
+func BodyLimitMiddleware(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tooLarge := gin.H{"error": "The request body is too large"}
+
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+
+		if int64(len(body)) > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
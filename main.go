@@ -2,132 +2,289 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// build information, set at build time with -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = "dev"
+	date    = "unknown"
+)
+
+// the commands of the CLI, printed when the command is missing or unknown
+const usage = `Usage: calc-notebook <command> [flags] [files]
+
+Commands:
+  execute      print the result of each line
+  validate     check the syntax and the units of each line without executing them
+  colorize     print the code as colorized HTML
+  latex        typeset each line as a LaTeX formula
+  interactive  evaluate each line as soon as it is entered
+  server       answer the requests of the HTTP API
+  version      print the version`
+
+var commands = []string{"execute", "validate", "colorize", "latex", "interactive", "server", "version"}
+
 func main() {
 	argsWithoutProg := os.Args[1:]
 
 	if len(argsWithoutProg) < 1 {
-		fmt.Print("You need to pass the command and the path of the file to execute")
+		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(1)
 	}
 
 	command := argsWithoutProg[0]
 
+	if !containsString(commands, command) {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n%s\n", command, usage)
+		os.Exit(1)
+	}
+
+	if command == "version" {
+		fmt.Printf("calc-notebook %s (commit %s, built %s)\n", version, commit, date)
+		return
+	}
+
 	sourceCode := ""
 	LoadUnitAliases()
 
 	if command == "server" {
-		gin.SetMode(gin.ReleaseMode)
-		r := gin.Default()
+		// the port can be set with the -port flag or the PORT environment variable
+		defaultPort := os.Getenv("PORT")
+		if defaultPort == "" {
+			defaultPort = "7894"
+		}
 
-		r.POST("/execute", func(c *gin.Context) {
-			raw_body, err := ioutil.ReadAll(c.Request.Body)
+		// the origins allowed to call the server from a browser, by default only local development servers
+		defaultOrigins := os.Getenv("CORS_ORIGINS")
+		if defaultOrigins == "" {
+			defaultOrigins = "http://localhost:*,http://127.0.0.1:*"
+		}
 
-			if err != nil {
-				c.JSON(500, gin.H{
-					"error": err.Error(),
-				})
+		serverFlags := flag.NewFlagSet("server", flag.ExitOnError)
+		port := serverFlags.String("port", defaultPort, "port the server listens on")
+		origins := serverFlags.String("cors-origins", defaultOrigins, "comma separated origins allowed by CORS, * allows every origin")
+		fetchRates := serverFlags.Bool("fetch-rates", false, "fetch the currency rates from exchangeratesapi.io, using the EXCHANGE_RATES_API_KEY environment variable")
+		ratesRefresh := serverFlags.Duration("rates-refresh", time.Hour, "interval between two fetches of the currency rates")
+		maxBodySize := serverFlags.Int64("max-body-size", 1<<20, "maximum size in bytes of the request bodies")
+		timeout := serverFlags.Duration("timeout", 10*time.Second, "maximum duration of the execution of a request")
+		serverFlags.Parse(argsWithoutProg[1:])
+
+		server := newAPIServer(*timeout)
+
+		// the fetched rates are applied like the ones set through /currencies, if a fetch fails the previous rates are kept
+		if *fetchRates {
+			apiKey := os.Getenv("EXCHANGE_RATES_API_KEY")
+
+			go func() {
+				for {
+					fetched, err := fetchCurrencyRates(ExchangeRatesURL, apiKey)
 
-				return
+					if err != nil {
+						log.Printf("Could not fetch the currency rates: %s", err)
+					} else {
+						rates, _ := CurrencyRates(fetched)
+						server.setRates(rates)
+					}
+
+					time.Sleep(*ratesRefresh)
+				}
+			}()
+		}
+
+		gin.SetMode(gin.ReleaseMode)
+		r := setupRouter(server, strings.Split(*origins, ","), *maxBodySize)
+
+		log.Printf("Listening on port %s", *port)
+		if err := r.Run(":" + *port); err != nil {
+			log.Fatal(err)
+		}
+	} else if command == "interactive" {
+		// evaluate each line as soon as it is entered, keeping the previous definitions
+		graph := ExecutionGraph{}
+		scanner := bufio.NewScanner(os.Stdin)
+
+		fmt.Print("> ")
+		for scanner.Scan() {
+			for _, line := range graph.AppendLine(scanner.Text()) {
+				if !line.IsEmpty() || line.HasError() {
+					fmt.Println(graph.LineResult(line))
+				}
 			}
 
-			fmt.Println(string(raw_body))
-			graph := ParseCode(string(raw_body))
-			graph.Execute()
-			c.String(200, graph.ExecutionResult())
-		})
-		r.POST("/colorize", func(c *gin.Context) {
-			raw_body, err := ioutil.ReadAll(c.Request.Body)
+			fmt.Print("> ")
+		}
+		fmt.Println()
+	} else {
+		commandFlags := flag.NewFlagSet(command, flag.ExitOnError)
+		jsonOutput := commandFlags.Bool("json", false, "print the results as a JSON array")
+		precision := commandFlags.Int("precision", 0, "number of significant digits of the results, 0 keeps the default formatting")
+		simplify := commandFlags.Bool("simplify", false, "express the results as named derived units when possible, e.g. N")
+		scalePrefixes := commandFlags.Bool("scale-prefixes", false, "express the results with the SI prefix that brings the value between 1 and 1000")
+		thousandsSeparators := commandFlags.Bool("thousands-separators", false, "group the digits of the results in thousands")
+		decimalSeparator := commandFlags.String("decimal-separator", ",", "character used for decimals, either , or ., the other one separates the thousands in groups of 3 digits")
+		allowInfinity := commandFlags.Bool("allow-infinity", false, "let divisions by zero and other operations result in infinities instead of errors")
+		watch := commandFlags.Bool("watch", false, "execute the files again and print the results whenever they change, until interrupted")
+		commandFlags.Parse(argsWithoutProg[1:])
+
+		// if paths are passed read the files from the paths, one after the other
+		var sourceFiles []SourceFile
+		if commandFlags.NArg() > 0 {
+			var err error
+			sourceCode, sourceFiles, err = readSourceFiles(commandFlags.Args())
 
 			if err != nil {
-				c.JSON(500, gin.H{
-					"error": err.Error(),
-				})
+				log.Fatalf("Problems reading the files: %s", err)
+			}
 
-				return
+			// the positions mention the file only when there are several of them
+			if len(sourceFiles) == 1 {
+				sourceFiles = nil
 			}
+		} else {
+			rawSource, err := ioutil.ReadAll(os.Stdin)
 
-			graph := ExecutionGraph{SourceCode: string(raw_body)}
-			graph.Tokenize(true)
-
-			c.String(200, graph.ColorizedHTML())
-		})
-		r.POST("/currencies", func(c *gin.Context) {
-			var conversionRates struct {
-				USD float64
-				GBP float64
-				CNY float64
-				CAD float64
+			if err != nil {
+				log.Fatalf("Problems reading from input: %s", err)
 			}
-			if err := c.ShouldBindJSON(&conversionRates); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
+			sourceCode = string(rawSource)
+		}
+
+		if command == "execute" {
+			graph := ExecutionGraph{SourceCode: sourceCode, Precision: *precision, SimplifyUnits: *simplify, ScalePrefixes: *scalePrefixes}
+			graph.ThousandsSeparators, graph.DecimalSeparator = *thousandsSeparators, *decimalSeparator
+			graph.AllowInfinity = *allowInfinity
+			graph.SourceFiles = sourceFiles
+
+			printResults := func() {
+				if *jsonOutput {
+					output, err := json.MarshalIndent(graph.ExecutionResultJSON(), "", "  ")
+
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					fmt.Println(string(output))
+				} else {
+					fmt.Println(graph.ExecutionResult())
+				}
 			}
 
-			usdUnit := UnitTable["usd"]
-			usdUnit.ConversionFactor = 1 / conversionRates.USD
-			UnitTable["usd"] = usdUnit
+			err := graph.Parse()
 
-			gbpUnit := UnitTable["gbp"]
-			gbpUnit.ConversionFactor = 1 / conversionRates.GBP
-			UnitTable["gbp"] = gbpUnit
+			if err != nil && !*watch {
+				fmt.Println(err)
+				os.Exit(1)
+			} else if err != nil {
+				// parsed again from scratch at the next change
+				graph.Lines = nil
+				fmt.Println(err)
+			} else {
+				graph.Execute()
+				printResults()
+			}
 
-			cnyUnit := UnitTable["cny"]
-			cnyUnit.ConversionFactor = 1 / conversionRates.CNY
-			UnitTable["cny"] = cnyUnit
+			if *watch {
+				if commandFlags.NArg() == 0 {
+					log.Fatal("The watch mode needs the paths of the files to watch")
+				}
 
-			cadUnit := UnitTable["cad"]
-			cadUnit.ConversionFactor = 1 / conversionRates.CAD
-			UnitTable["cad"] = cadUnit
+				// the files are executed again from scratch only if the lines of a file were added or removed,
+				// otherwise only the changed lines and their dependents are executed again
+				err := watchFiles(commandFlags.Args(), 100*time.Millisecond, func() {
+					sourceCode, files, err := readSourceFiles(commandFlags.Args())
 
-			c.JSON(200, gin.H{"ok": true})
-		})
+					// clears the terminal before printing the new results
+					fmt.Print("\033[H\033[2J")
 
-		r.Run(":7894")
-	} else {
+					if err != nil {
+						fmt.Println(err)
+						return
+					}
 
-		// if path is passed read file from path
-		if len(argsWithoutProg) > 1 {
-			rawSource, err := ioutil.ReadFile(argsWithoutProg[1])
+					if len(files) == 1 {
+						files = nil
+					}
 
-			if err != nil {
-				panic(err)
-			}
-			sourceCode = string(rawSource)
-		} else {
-			reader := bufio.NewReader(os.Stdin)
-
-			for {
-				data := make([]byte, 1<<16) // read in blocks of 2^16 Bytes
-				count, err := reader.Read(data)
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					log.Fatalf("Problems reading from input: %s", err)
-				}
+					if graph.Lines == nil || !sameSourceFiles(files, graph.SourceFiles) {
+						graph.SourceCode, graph.SourceFiles, graph.Lines = sourceCode, files, nil
+						err = graph.Parse()
 
-				sourceCode += string(data[:count])
+						if err == nil {
+							graph.Execute()
+						}
+					} else {
+						err = graph.UpdateSource(sourceCode)
+					}
+
+					if err != nil {
+						graph.Lines = nil
+						fmt.Println(err)
+					} else {
+						printResults()
+					}
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
 			}
-		}
+		} else if command == "validate" {
+			// checks the syntax and the units of every line without executing them
+			graph := ExecutionGraph{SourceCode: sourceCode, DecimalSeparator: *decimalSeparator, SourceFiles: sourceFiles}
 
-		if command == "execute" {
-			graph := ParseCode(sourceCode)
-			graph.Execute()
+			if err := graph.Parse(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
 
-			fmt.Println(graph.ExecutionResult())
+			if !graph.CheckUnits() {
+				fmt.Println(strings.Join(graph.ErrorMessages(), "\n"))
+				os.Exit(1)
+			}
 		} else if command == "colorize" {
-			graph := ExecutionGraph{SourceCode: sourceCode}
-			graph.Tokenize(true)
+			graph, _ := ParseCode(sourceCode)
 			fmt.Println(graph.ColorizedHTML())
+		} else if command == "latex" {
+			graph, err := ParseCode(sourceCode)
+
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			fmt.Println(graph.LaTeX())
 		}
 	}
 }
+
+// Reads the files and concatenates them, one after the other, so that the later files can use the variables
+// defined in the earlier ones, returning the number of lines of each
+func readSourceFiles(paths []string) (string, []SourceFile, error) {
+	sources := []string{}
+	files := []SourceFile{}
+
+	for _, path := range paths {
+		rawSource, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		// the final newline does not start another line, which would shift the lines of the next file
+		source := strings.TrimSuffix(string(rawSource), "\n")
+		sources = append(sources, source)
+		files = append(files, SourceFile{Name: path, Lines: strings.Count(source, "\n") + 1})
+	}
+
+	return strings.Join(sources, "\n"), files, nil
+}
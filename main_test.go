@@ -3,7 +3,15 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestParseExecute(t *testing.T) {
@@ -15,11 +23,312 @@ func TestParseExecute(t *testing.T) {
 	}
 	sourceCode := string(rawSource)
 
-	graph := ParseCode(sourceCode)
+	graph, err := ParseCode(sourceCode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
 	graph.Execute()
 
 	fmt.Println(graph.Lines[0].Value)
-	if graph.Lines[0].Value != 71 {
-		t.Errorf("Output should be 71")
+	if graph.Lines[0].Value != 97 {
+		t.Errorf("Output should be 97")
+	}
+}
+
+func TestExecutionResult(t *testing.T) {
+	rawSource, err := ioutil.ReadFile("./test.cal")
+
+	if err != nil {
+		panic(err)
+	}
+
+	graph, err := ParseCode(string(rawSource))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	expected := strings.Join([]string{
+		"97",
+		"X",
+		"run: 5 km",
+		"walk: 3.5 km",
+		"X",
+		"5.281655 mi",
+		"pace: 6 min / km",
+		"total: ! Units are not compatible",
+	}, "\n")
+
+	if result := graph.ExecutionResult(); result != expected {
+		t.Errorf("The result should be\n%s\ngot\n%s\ninstead", expected, result)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CORSMiddleware([]string{"http://localhost:*", "https://calc.example.com"}))
+	r.POST("/execute", func(c *gin.Context) { c.String(200, "ok") })
+
+	for _, origin := range []string{"http://localhost:3000", "https://calc.example.com"} {
+		request := httptest.NewRequest(http.MethodOptions, "/execute", nil)
+		request.Header.Set("Origin", origin)
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+
+		if response.Code != http.StatusNoContent || response.Header().Get("Access-Control-Allow-Origin") != origin {
+			t.Errorf("The preflight from %s should be allowed, got %d %v instead", origin, response.Code, response.Header())
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/execute", nil)
+	request.Header.Set("Origin", "https://evil.example.com")
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+
+	if response.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Requests from other origins should not be allowed")
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(BodyLimitMiddleware(10))
+	r.POST("/execute", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(200, string(body))
+	})
+
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/execute", strings.NewReader("1 + 2")))
+
+	if response.Code != 200 || response.Body.String() != "1 + 2" {
+		t.Errorf("Small bodies should be accepted, got %d %s instead", response.Code, response.Body.String())
+	}
+
+	// without a content length the body is measured while reading it
+	request := httptest.NewRequest(http.MethodPost, "/execute", strings.NewReader("1 + 2 + 3 + 4"))
+	request.ContentLength = -1
+	response = httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Large bodies should be rejected with 413, got %d instead", response.Code)
+	}
+}
+
+func TestFetchCurrencyRates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"success": false, "error": {"info": "invalid key"}}`))
+			return
+		}
+
+		w.Write([]byte(`{"success": true, "base": "EUR", "rates": {"USD": 1.19, "GBP": 0.85}}`))
+	}))
+	defer server.Close()
+
+	rates, err := fetchCurrencyRates(server.URL, "key")
+	if err != nil || rates["USD"] != 1.19 || rates["GBP"] != 0.85 {
+		t.Errorf("The rates should be fetched, got %v (%v) instead", rates, err)
+	}
+
+	if _, err := fetchCurrencyRates(server.URL, "wrong"); err == nil {
+		t.Errorf("Fetching with an invalid key should fail")
+	}
+}
+
+func TestExecuteLargeStdin(t *testing.T) {
+	originalArgs, originalStdin, originalStdout := os.Args, os.Stdin, os.Stdout
+	defer func() { os.Args, os.Stdin, os.Stdout = originalArgs, originalStdin, originalStdout }()
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more than 64KB of source, written in small chunks
+	lines := 20000
+	go func() {
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(stdinWriter, "%d + 1\n", i)
+		}
+		fmt.Fprint(stdinWriter, "ans")
+		stdinWriter.Close()
+	}()
+
+	output := make(chan string)
+	go func() {
+		rawOutput, _ := ioutil.ReadAll(stdoutReader)
+		output <- string(rawOutput)
+	}()
+
+	os.Args = []string{"calc-notebook", "execute"}
+	os.Stdin, os.Stdout = stdinReader, stdoutWriter
+	main()
+	stdoutWriter.Close()
+
+	results := strings.Split(strings.TrimSpace(<-output), "\n")
+
+	if len(results) != lines+1 || results[lines] != fmt.Sprintf("%d", lines) {
+		t.Errorf("The whole input should be executed, got %d results ending with %s instead", len(results), results[len(results)-1])
+	}
+}
+
+func TestReadSourceFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "calc-notebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	defs, calc := filepath.Join(directory, "defs.cal"), filepath.Join(directory, "calc.cal")
+	if err := ioutil.WriteFile(defs, []byte("speed: 10 [km/h]\nduration: 2 [h]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(calc, []byte("speed * duration [km]\nspeed + duration\n3 + $"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sourceCode, sourceFiles, err := readSourceFiles([]string{defs, calc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graph := ExecutionGraph{SourceCode: sourceCode, SourceFiles: sourceFiles}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	graph.Execute()
+
+	if len(graph.Lines) != 5 || graph.Lines[2].HasError() || graph.Lines[2].Value != 20 {
+		t.Fatalf("The second file should use the variables of the first one, got %s instead", graph.ExecutionResult())
+	}
+
+	expected := []string{
+		fmt.Sprintf("Units are not compatible (%s:2)", calc),
+		fmt.Sprintf("The currency symbol $ must precede or follow a number, e.g. $10 (%s:3, column 5)", calc),
+	}
+	if messages := graph.ErrorMessages(); strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("The errors should be\n%s\ngot\n%s\ninstead", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+
+	if result := graph.ExecutionResultJSON()[3]; result.File != calc || result.Line != 2 {
+		t.Errorf("The fourth line should be reported in %s:2, got %s:%d instead", calc, result.File, result.Line)
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	directory, err := ioutil.TempDir("", "calc-notebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "calc.cal")
+	if err := ioutil.WriteFile(path, []byte("1 + 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := newFileWatcher([]string{path}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	changed := func() bool {
+		select {
+		case <-watcher.Changes:
+			return true
+		case <-time.After(500 * time.Millisecond):
+			return false
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(directory, "other.cal"), []byte("3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed() {
+		t.Errorf("The changes of the other files in the directory should not be reported")
+	}
+
+	// rewritten with the same size, within the resolution of the modification time
+	for _, source := range []string{"1 + 3", "1 + 4"} {
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !changed() {
+		t.Errorf("A modified file should be reported as changed")
+	}
+	if changed() {
+		t.Errorf("The writes close to each other should be reported once")
+	}
+
+	// editors often save by replacing the file
+	if err := os.Rename(filepath.Join(directory, "other.cal"), path); err != nil {
+		t.Fatal(err)
+	}
+	if !changed() {
+		t.Errorf("A replaced file should be reported as changed")
+	}
+
+	os.Remove(path)
+	if !changed() {
+		t.Errorf("A removed file should be reported as changed")
+	}
+}
+
+func TestServerEndpoints(t *testing.T) {
+	LoadUnitAliases()
+	gin.SetMode(gin.TestMode)
+	router := setupRouter(newAPIServer(time.Second), []string{"*"}, 256)
+
+	// larger than the maximum body size of the router
+	large := strings.Repeat("1 + ", 100) + "1"
+
+	cases := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		contains string
+	}{
+		{http.MethodPost, "/eval", `{"expr": "2 * 2 [m]"}`, 200, `"value":4`},
+		{http.MethodPost, "/eval", `{"expr": "(2 [m]) + (3 [s])"}`, 400, "Units are not compatible"},
+		{http.MethodPost, "/eval", `{"expr": "` + large + `"}`, 413, "too large"},
+		{http.MethodPost, "/execute", "x: 1 + 2\nx * 2", 200, "x: 3\n6"},
+		{http.MethodPost, "/execute?precision=-1", "1 + 2", 400, "precision"},
+		{http.MethodPost, "/execute", large, 413, "too large"},
+		{http.MethodPost, "/convert", `{"value": 1, "from": "km", "to": "m"}`, 200, `"value":1000`},
+		{http.MethodPost, "/convert", `{"value": 1, "from": "km", "to": "s"}`, 400, "Units are not compatible"},
+		{http.MethodPost, "/convert", `{"value": 1, "from": "` + large + `"}`, 413, "too large"},
+		{http.MethodPost, "/plot", `{"source": "y: x^2", "function": "y", "from": 0, "to": 2, "steps": 2}`, 200, `{"x":2,"y":4}`},
+		{http.MethodPost, "/plot", `{"source": "y: x^2", "function": "z"}`, 400, "Variable z is not defined"},
+		{http.MethodPost, "/plot", `{"source": "` + large + `"}`, 413, "too large"},
+		{http.MethodPost, "/currencies", `{"USD": 2, "XYZ": 1}`, 200, `"ignored":["XYZ"]`},
+		{http.MethodPost, "/currencies", `{"USD": "2"}`, 400, "error"},
+		{http.MethodPost, "/currencies", `{"USD": ` + large + `}`, 413, "too large"},
+		// the units list the rates set through /currencies, the errors of the source do not affect them
+		{http.MethodGet, "/units", "", 200, `"id":"usd","displayValue":"$","aliases":["$","usd","USD"],"rate":2}`},
+		{http.MethodPost, "/units", "unit furlong = 201,168 [m]\n1 +", 200, `"id":"furlong"`},
+		{http.MethodPost, "/units", large, 413, "too large"},
+	}
+
+	for _, test := range cases {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+
+		if response.Code != test.status || !strings.Contains(response.Body.String(), test.contains) {
+			t.Errorf("%s %s should answer %d with %s, got %d %s instead", test.method, test.path, test.status, test.contains, response.Code, response.Body.String())
+		}
 	}
 }
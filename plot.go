@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// PlotPoint is a point of the plot of a variable as a function of another one
+type PlotPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// MaxPlotSteps is the maximum number of steps of a plot
+const MaxPlotSteps = 10_000
+
+// Plot evaluates the variable function of an executed graph for steps+1 values of the variable x evenly spaced
+// between from and to, both included. Only the lines depending on x are executed again for each value, which keeps
+// the unit of its definition, e.g. `x: 0 [s]`. The values for which the function has an error are skipped,
+// and the lines are restored to the value of x in the code afterwards
+func (graph *ExecutionGraph) Plot(function string, x string, from float64, to float64, steps int) ([]PlotPoint, error) {
+	return graph.PlotContext(context.Background(), function, x, from, to, steps)
+}
+
+// PlotContext plots the function like Plot, stopping as soon as the context is done and returning its error,
+// after restoring the lines
+func (graph *ExecutionGraph) PlotContext(ctx context.Context, function string, x string, from float64, to float64, steps int) ([]PlotPoint, error) {
+	if steps < 1 {
+		return nil, fmt.Errorf("The plot needs at least one step")
+	}
+	if steps > MaxPlotSteps {
+		return nil, fmt.Errorf("The plot can have at most %d steps", MaxPlotSteps)
+	}
+
+	variable, ok := graph.Variables[x]
+	if !ok {
+		return nil, fmt.Errorf("Variable %s is not defined", x)
+	}
+	functionLine, ok := graph.Variables[function]
+	if !ok {
+		return nil, fmt.Errorf("Variable %s is not defined", function)
+	}
+
+	line := &graph.Lines[variable]
+	if line.IsEmpty() {
+		return nil, fmt.Errorf("Variable %s is defined by an empty expression", x)
+	}
+	if line.HasError() {
+		return nil, line.Error
+	}
+
+	original := line.Value
+	points := []PlotPoint{}
+
+	graph.ctx = ctx
+	for i := 0; i <= steps && ctx.Err() == nil; i++ {
+		line.Value = from + (to-from)*float64(i)/float64(steps)
+		graph.executeDependents(graph.Dependents[variable])
+
+		if result := &graph.Lines[functionLine]; !result.HasError() {
+			points = append(points, PlotPoint{X: line.Value, Y: result.Value})
+		}
+	}
+	graph.ctx = nil
+
+	line.Value = original
+	graph.executeDependents(graph.Dependents[variable])
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
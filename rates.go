@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ExchangeRatesURL is the endpoint of exchangeratesapi.io returning the latest rates relative to the euro
+const ExchangeRatesURL = "https://api.exchangeratesapi.io/v1/latest"
+
+// Fetches the latest currency rates relative to the euro, by currency code
+func fetchCurrencyRates(endpoint string, apiKey string) (map[string]float64, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+
+	response, err := client.Get(endpoint + "?base=EUR&access_key=" + url.QueryEscape(apiKey))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var body struct {
+		Success bool
+		Rates   map[string]float64
+		Error   struct {
+			Info string
+		}
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK || !body.Success {
+		return nil, fmt.Errorf("Fetching the currency rates failed with status %d: %s", response.StatusCode, body.Error.Info)
+	}
+
+	return body.Rates, nil
+}
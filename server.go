@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiServer holds the state shared by the handlers of the server
+type apiServer struct {
+	// maximum duration of the execution of a request
+	timeout time.Duration
+
+	// the currency rates set through /currencies or fetched, which apply to every following request, by currency ID
+	rates     map[string]float64
+	ratesLock sync.RWMutex
+}
+
+// Creates a server with no currency rates, whose executions last at most timeout
+func newAPIServer(timeout time.Duration) *apiServer {
+	return &apiServer{timeout: timeout, rates: map[string]float64{}}
+}
+
+// setupRouter registers the handlers of the server, after the CORS and body size middlewares
+func setupRouter(server *apiServer, origins []string, maxBodySize int64) *gin.Engine {
+	r := gin.Default()
+	r.Use(CORSMiddleware(origins))
+	r.Use(BodyLimitMiddleware(maxBodySize))
+
+	r.POST("/execute", server.handleExecute)
+	r.POST("/eval", server.handleEval)
+	r.POST("/colorize", handleColorize)
+	r.GET("/colorize.css", handleColorizeCSS)
+	r.POST("/ast", handleAst)
+	r.POST("/latex", handleLaTeX)
+	r.POST("/tokenize", handleTokenize)
+	r.POST("/convert", server.handleConvert)
+	r.POST("/plot", server.handlePlot)
+	r.GET("/units", server.handleUnits)
+	r.POST("/units", server.handleUnits)
+	r.POST("/currencies", server.handleCurrencies)
+
+	return r
+}
+
+// Adds the rates to the ones of the server, replacing the rates of the same currencies
+func (server *apiServer) setRates(rates map[string]float64) {
+	server.ratesLock.Lock()
+	for id, rate := range rates {
+		server.rates[id] = rate
+	}
+	server.ratesLock.Unlock()
+}
+
+// Creates a graph of the source code applying the currency rates of the server
+func (server *apiServer) newGraph(sourceCode string) ExecutionGraph {
+	graph := ExecutionGraph{SourceCode: sourceCode, CurrencyRates: map[string]float64{}}
+
+	server.ratesLock.RLock()
+	for id, rate := range server.rates {
+		graph.CurrencyRates[id] = rate
+	}
+	server.ratesLock.RUnlock()
+
+	return graph
+}
+
+// Executes the graph within the timeout, answering 408 if it runs out
+func (server *apiServer) execute(c *gin.Context, graph *ExecutionGraph) bool {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), server.timeout)
+	defer cancel()
+
+	if err := graph.ExecuteContext(ctx); err != nil {
+		c.JSON(http.StatusRequestTimeout, gin.H{"error": "The execution took too long"})
+		return false
+	}
+
+	return true
+}
+
+func (server *apiServer) handleExecute(c *gin.Context) {
+	// a JSON body can override the currency rates for this request, otherwise the body is the source code
+	var request struct {
+		Source string
+		Rates  map[string]float64
+	}
+
+	if c.ContentType() == "application/json" {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		raw_body, err := ioutil.ReadAll(c.Request.Body)
+
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		request.Source = string(raw_body)
+	}
+
+	graph := server.newGraph(request.Source)
+
+	// the number of significant digits of the results can be set with the precision query parameter
+	if precision := c.Query("precision"); precision != "" {
+		value, err := strconv.Atoi(precision)
+
+		if err != nil || value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The precision must be a non negative integer"})
+			return
+		}
+
+		graph.Precision = value
+	}
+
+	graph.SimplifyUnits = c.Query("simplify") == "true"
+	graph.ScalePrefixes = c.Query("scale-prefixes") == "true"
+	graph.ThousandsSeparators = c.Query("thousands-separators") == "true"
+	graph.DecimalSeparator = c.DefaultQuery("decimal-separator", ",")
+	graph.AllowInfinity = c.Query("allow-infinity") == "true"
+
+	requestRates, _ := CurrencyRates(request.Rates)
+	for id, rate := range requestRates {
+		graph.CurrencyRates[id] = rate
+	}
+
+	err := graph.Parse()
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	if !server.execute(c, &graph) {
+		return
+	}
+
+	// plain text is offered first, so that it stays the default for a missing or wildcard Accept header
+	if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(200, graph.ExecutionResultJSON())
+	} else {
+		c.String(200, graph.ExecutionResult())
+	}
+}
+
+// Evaluates a single expression, e.g. {"expr": "2 * 2 [m]"}
+func (server *apiServer) handleEval(c *gin.Context) {
+	var request struct {
+		Expr string
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"value": nil, "unit": nil, "error": err.Error()})
+		return
+	}
+
+	graph := server.newGraph(request.Expr)
+
+	if err := graph.Parse(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"value": nil, "unit": nil, "error": err.Error()})
+		return
+	}
+
+	if !server.execute(c, &graph) {
+		return
+	}
+
+	result := graph.ExpressionResultJSON()
+	if result.Error != nil {
+		c.JSON(http.StatusBadRequest, result)
+	} else {
+		c.JSON(200, result)
+	}
+}
+
+func handleColorize(c *gin.Context) {
+	raw_body, err := ioutil.ReadAll(c.Request.Body)
+
+	if err != nil {
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	// the code is parsed to mark the lines with an error, cyclical definitions do not affect the colors
+	graph, _ := ParseCode(string(raw_body))
+
+	c.String(200, graph.ColorizedHTML())
+}
+
+func handleColorizeCSS(c *gin.Context) {
+	css, err := ColorizedCSS(c.DefaultQuery("theme", "light"))
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(200, "text/css; charset=utf-8", []byte(css))
+}
+
+func handleAst(c *gin.Context) {
+	raw_body, err := ioutil.ReadAll(c.Request.Body)
+
+	if err != nil {
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	// the lines of cyclical definitions report the error, while the other lines keep their parse tree
+	graph, err := ParseCode(string(raw_body))
+	if err != nil {
+		graph.markCyclicalDependencies()
+	}
+
+	c.JSON(200, graph.AstJSON())
+}
+
+func handleLaTeX(c *gin.Context) {
+	raw_body, err := ioutil.ReadAll(c.Request.Body)
+
+	if err != nil {
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	graph, err := ParseCode(string(raw_body))
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	c.String(200, graph.LaTeX())
+}
+
+func handleTokenize(c *gin.Context) {
+	raw_body, err := ioutil.ReadAll(c.Request.Body)
+
+	if err != nil {
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	graph := ExecutionGraph{SourceCode: string(raw_body)}
+	graph.Tokenize(true)
+
+	c.JSON(200, graph.TokenizationJSON())
+}
+
+// Converts a value between two units, applying the rates of the server like the execution of the notebooks
+func (server *apiServer) handleConvert(c *gin.Context) {
+	var conversion struct {
+		Value float64
+		From  string
+		To    string
+	}
+	if err := c.ShouldBindJSON(&conversion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	graph := server.newGraph("")
+
+	from, err := graph.ParseUnit(conversion.From)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	to, err := graph.ParseUnit(conversion.To)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	value, err := ConvertCompositeUnitsExplicitly(conversion.Value, from, to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"value": value, "unit": to.String()})
+}
+
+// Plots the function over the variable, which is defined as 0 when the source does not define it
+func (server *apiServer) handlePlot(c *gin.Context) {
+	request := struct {
+		Source   string
+		Function string
+		Variable string
+		From     float64
+		To       float64
+		Steps    int
+	}{Variable: "x", Steps: 100}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	graph := server.newGraph(request.Source)
+
+	if err := graph.Parse(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := graph.Variables[request.Variable]; !ok {
+		graph = ExecutionGraph{SourceCode: request.Source + "\n" + request.Variable + ": 0", CurrencyRates: graph.CurrencyRates}
+
+		if err := graph.Parse(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// the execution and the plot share the same timeout
+	ctx, cancel := context.WithTimeout(c.Request.Context(), server.timeout)
+	defer cancel()
+
+	if err := graph.ExecuteContext(ctx); err != nil {
+		c.JSON(http.StatusRequestTimeout, gin.H{"error": "The execution took too long"})
+		return
+	}
+
+	points, err := graph.PlotContext(ctx, request.Function, request.Variable, request.From, request.To, request.Steps)
+	if err != nil && ctx.Err() != nil {
+		c.JSON(http.StatusRequestTimeout, gin.H{"error": "The execution took too long"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, points)
+}
+
+// Lists the units with the rates of the server, POST /units also lists the units declared by the source
+// in the body, e.g. `unit furlong = 201,168 [m]`
+func (server *apiServer) handleUnits(c *gin.Context) {
+	raw_body, err := ioutil.ReadAll(c.Request.Body)
+
+	if err != nil {
+		c.JSON(500, gin.H{
+			"error": err.Error(),
+		})
+
+		return
+	}
+
+	graph := server.newGraph(string(raw_body))
+
+	// the errors of the other lines, e.g. cyclical definitions, do not affect the declared units
+	graph.Parse()
+
+	c.JSON(200, graph.UnitsByBaseUnit())
+}
+
+// Sets the currency rates applied to the following requests, e.g. {"USD": 1.1}
+func (server *apiServer) handleCurrencies(c *gin.Context) {
+	// map from currency code to the rate relative to the euro
+	var conversionRates map[string]float64
+	if err := c.ShouldBindJSON(&conversionRates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rates, ignored := CurrencyRates(conversionRates)
+	server.setRates(rates)
+
+	c.JSON(200, gin.H{"ok": true, "ignored": ignored})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ColorizeThemes are the colors of the tokens in the colorized HTML for each theme, by token kind,
+// all the tokens of a unit share the unit color
+var ColorizeThemes = map[string]map[string]string{
+	"light": {
+		"number":   "#098658",
+		"operator": "#000000",
+		"unit":     "#267f99",
+		"function": "#795e26",
+		"constant": "#0000ff",
+		"literal":  "#001080",
+		"string":   "#a31515",
+		"comment":  "#008000",
+		"unknown":  "#cd3131",
+		"error":    "#e51400",
+	},
+	"dark": {
+		"number":   "#b5cea8",
+		"operator": "#d4d4d4",
+		"unit":     "#4ec9b0",
+		"function": "#dcdcaa",
+		"constant": "#569cd6",
+		"literal":  "#9cdcfe",
+		"string":   "#ce9178",
+		"comment":  "#6a9955",
+		"unknown":  "#f44747",
+		"error":    "#f14c4c",
+	},
+}
+
+// the token kinds that can appear inside the brackets of a unit, where they are tagged with the -unit suffix
+var unitTokenKinds = []string{"bracket", "literal", "function", "constant", "number", "operator", "paren", "whitespace", "unknown"}
+
+// ColorizedCSS returns the stylesheet coloring the classes of ColorizedHTML with the given theme, either light or dark
+func ColorizedCSS(theme string) (string, error) {
+	colors, ok := ColorizeThemes[theme]
+	if !ok {
+		return "", fmt.Errorf("Unknown theme %s", theme)
+	}
+
+	kinds := []string{}
+	for kind := range colors {
+		if kind != "unit" && kind != "error" {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+
+	rules := []string{}
+	for _, kind := range kinds {
+		rules = append(rules, fmt.Sprintf(".calc-token-%s { color: %s; }", kind, colors[kind]))
+	}
+
+	unitSelectors := []string{}
+	for _, kind := range unitTokenKinds {
+		unitSelectors = append(unitSelectors, ".calc-token-"+kind+"-unit")
+	}
+	rules = append(rules, fmt.Sprintf("%s { color: %s; }", strings.Join(unitSelectors, ", "), colors["unit"]))
+
+	rules = append(rules,
+		fmt.Sprintf(".calc-line-error { text-decoration: underline dotted %s; }", colors["error"]),
+		fmt.Sprintf(".calc-token-error { text-decoration: underline wavy %s; }", colors["error"]),
+	)
+
+	return strings.Join(rules, "\n") + "\n", nil
+}
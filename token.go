@@ -6,8 +6,18 @@ import "fmt"
 type Token struct {
 	Kind  string
 	Value string
+	Start int // offset of the first character in the line
+	End   int // offset of the character following the token in the line
 }
 
 func (t Token) String() string {
 	return fmt.Sprintf("[%s] %s", t.Kind, t.Value)
 }
+
+// TokenResult is the serializable form of a token, with the offsets of its first character and of the following one
+type TokenResult struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 type FundamentalUnit struct {
@@ -16,22 +17,107 @@ type FundamentalUnit struct {
 	ConversionShift  float64
 }
 
+// MetricPrefix is a prefix scaling a metric unit, e.g. kilo in kilometer, written with its first symbol
+type MetricPrefix struct {
+	Name    string
+	Symbols []string
+	Factor  float64
+}
+
+// MetricPrefixes lists the prefixes combined with the PrefixableUnits, from the smallest to the largest
+var MetricPrefixes = []MetricPrefix{
+	{"femto", []string{"f"}, math.Pow10(-15)},
+	{"pico", []string{"p"}, math.Pow10(-12)},
+	{"nano", []string{"n"}, math.Pow10(-9)},
+	{"micro", []string{"μ", "µ", "u"}, math.Pow10(-6)},
+	{"milli", []string{"m"}, math.Pow10(-3)},
+	{"centi", []string{"c"}, math.Pow10(-2)},
+	{"deci", []string{"d"}, math.Pow10(-1)},
+	{"deca", []string{"da"}, math.Pow10(1)},
+	{"hecto", []string{"h"}, math.Pow10(2)},
+	{"kilo", []string{"k"}, math.Pow10(3)},
+	{"mega", []string{"M"}, math.Pow10(6)},
+	{"giga", []string{"G"}, math.Pow10(9)},
+	{"tera", []string{"T"}, math.Pow10(12)},
+}
+
+// PrefixableUnits lists the units combined with every MetricPrefix along with their symbols, which take the symbol
+// of the prefix (e.g. kPa), while the other aliases take its name (e.g. kilopascal)
+var PrefixableUnits = map[string][]string{
+	"meter":   {"m"},
+	"gram":    {"g"},
+	"second":  {"s"},
+	"liter":   {"L", "l"},
+	"hertz":   {"Hz"},
+	"newton":  {"N"},
+	"joule":   {"J"},
+	"watt":    {"W"},
+	"pascal":  {"Pa"},
+	"ampere":  {"A"},
+	"volt":    {"V"},
+	"ohm":     {"Ω", "ohm"},
+	"coulomb": {},
+	"farad":   {},
+	"mole":    {"mol"},
+}
+
+// Adds to the table the PrefixableUnits combined with each MetricPrefix, e.g. kilopascal, named by the prefix
+// followed by the unit ID. The units and aliases already in the table take precedence over the generated ones
+func withPrefixedUnits(table map[string]FundamentalUnit) map[string]FundamentalUnit {
+	aliases := map[string]bool{}
+	for _, unit := range table {
+		for _, alias := range unit.Aliases {
+			aliases[alias] = true
+		}
+	}
+
+	for id, symbols := range PrefixableUnits {
+		unit := table[id]
+
+		for _, prefix := range MetricPrefixes {
+			if _, ok := table[prefix.Name+id]; ok {
+				continue
+			}
+
+			prefixed := FundamentalUnit{
+				ID:               prefix.Name + id,
+				DisplayValue:     prefix.Name + unit.DisplayValue,
+				Aliases:          []string{},
+				BaseUnit:         unit.BaseUnit,
+				ConversionFactor: unit.ConversionFactor * prefix.Factor,
+			}
+			if len(symbols) > 0 {
+				prefixed.DisplayValue = prefix.Symbols[0] + symbols[0]
+			}
+
+			candidates := []string{}
+			for _, alias := range unit.Aliases {
+				if containsString(symbols, alias) {
+					for _, symbol := range prefix.Symbols {
+						candidates = append(candidates, symbol+alias)
+					}
+				} else {
+					candidates = append(candidates, prefix.Name+alias)
+				}
+			}
+
+			for _, alias := range candidates {
+				if !aliases[alias] {
+					prefixed.Aliases = append(prefixed.Aliases, alias)
+				}
+			}
+
+			table[prefixed.ID] = prefixed
+		}
+	}
+
+	return table
+}
+
 var UnitAliasesMap map[string]string = map[string]string{}
-var UnitTable map[string]FundamentalUnit = map[string]FundamentalUnit{
+var UnitTable map[string]FundamentalUnit = withPrefixedUnits(map[string]FundamentalUnit{
 	// metric lengths
-	"meter":      {"meter", "m", []string{"m", "meter", "metre"}, "meter", 1, 0},
-	"decimeter":  {"decimeter", "dm", []string{"dm", "decimetre", "decimeter"}, "meter", math.Pow10(-1), 0},
-	"centimeter": {"centimeter", "cm", []string{"cm", "centimetre", "centimeter"}, "meter", math.Pow10(-2), 0},
-	"millimeter": {"millimeter", "mm", []string{"mm", "millimetre", "millimeter"}, "meter", math.Pow10(-3), 0},
-	"micrometer": {"micrometer", "μm", []string{"μm", "micrometre", "micrometer"}, "meter", math.Pow10(-6), 0},
-	"nanometer":  {"nanometer", "nm", []string{"nm", "nanometre", "nanometer"}, "meter", math.Pow10(-9), 0},
-	"picometer":  {"picometer", "pm", []string{"pm", "picometre", "picometer"}, "meter", math.Pow10(-12), 0},
-	"femtometer": {"femtometer", "fm", []string{"fm", "femtometre", "femtometer"}, "meter", math.Pow10(-15), 0},
-	"decameter":  {"decameter", "dam", []string{"dam", "decametre", "decameter"}, "meter", math.Pow10(1), 0},
-	"hectometer": {"hectometer", "hm", []string{"hm", "hectometre", "hectometer"}, "meter", math.Pow10(2), 0},
-	"kilometer":  {"kilometer", "km", []string{"km", "kilometre", "kilometer"}, "meter", math.Pow10(3), 0},
-	"megameter":  {"megameter", "Mm", []string{"Mm", "megametre", "megameter"}, "meter", math.Pow10(6), 0},
-	"gigameter":  {"gigameter", "Gm", []string{"Gm", "gigametre", "gigameter"}, "meter", math.Pow10(9), 0},
+	"meter": {"meter", "m", []string{"m", "meter", "metre"}, "meter", 1, 0},
 	// imperial lengths
 	"inch":          {"inch", "in", []string{"in", "inch", "inches"}, "meter", 0.0254, 0},
 	"foot":          {"foot", "ft", []string{"ft", "foot", "feet"}, "meter", 0.3048, 0},
@@ -43,79 +129,151 @@ var UnitTable map[string]FundamentalUnit = map[string]FundamentalUnit{
 	"astronomical_unit": {"astronomical_unit", "au", []string{"au", "astronomical_unit", "astronomical_units"}, "meter", 149_597_870_700, 0},
 	"light_year":        {"light_year", "ly", []string{"ly", "light_year", "light_years"}, "meter", 9_460_730_472_580_800, 0},
 
+	// area
+	"hectare": {"hectare", "ha", []string{"ha", "hectare", "hectares"}, "square_meter", math.Pow10(4), 0},
+	"acre":    {"acre", "ac", []string{"ac", "acre", "acres"}, "square_meter", 4046.8564224, 0},
+
+	// volume (US customary for gallons, quarts, pints, cups and spoons)
+	"liter":           {"liter", "L", []string{"L", "l", "liter", "litre", "liters", "litres"}, "cubic_meter", math.Pow10(-3), 0},
+	"gallon":          {"gallon", "gal", []string{"gal", "gallon", "gallons"}, "cubic_meter", 3.785411784e-3, 0},
+	"imperial_gallon": {"imperial_gallon", "imp_gal", []string{"imp_gal", "imperial_gallon", "imperial_gallons"}, "cubic_meter", 4.54609e-3, 0},
+	"quart":           {"quart", "qt", []string{"qt", "quart", "quarts"}, "cubic_meter", 0.946352946e-3, 0},
+	"pint":            {"pint", "pt", []string{"pt", "pint", "pints"}, "cubic_meter", 0.473176473e-3, 0},
+	"cup":             {"cup", "cup", []string{"cup", "cups"}, "cubic_meter", 0.2365882365e-3, 0},
+	"fluid_ounce":     {"fluid_ounce", "fl_oz", []string{"fl_oz", "floz", "fluid_ounce", "fluid_ounces"}, "cubic_meter", 29.5735295625e-6, 0},
+	"tablespoon":      {"tablespoon", "tbsp", []string{"tbsp", "tablespoon", "tablespoons"}, "cubic_meter", 14.78676478125e-6, 0},
+	"teaspoon":        {"teaspoon", "tsp", []string{"tsp", "teaspoon", "teaspoons"}, "cubic_meter", 4.92892159375e-6, 0},
+
+	// speed
+	"meter_per_second":   {"meter_per_second", "m/s", []string{"mps", "meter_per_second", "meters_per_second"}, "meter_per_second", 1, 0},
+	"kilometer_per_hour": {"kilometer_per_hour", "km/h", []string{"kmh", "kph", "kilometer_per_hour", "kilometers_per_hour"}, "meter_per_second", float64(1000) / 3600, 0},
+	"mile_per_hour":      {"mile_per_hour", "mph", []string{"mph", "mile_per_hour", "miles_per_hour"}, "meter_per_second", 1609.344 / 3600, 0},
+	"knot":               {"knot", "kn", []string{"kn", "knot", "knots"}, "meter_per_second", float64(1852) / 3600, 0},
+
+	// fuel economy (US gallons) and its reciprocal, the fuel consumption
+	"mile_per_gallon":          {"mile_per_gallon", "mpg", []string{"mpg", "mile_per_gallon", "miles_per_gallon"}, "fuel_economy", 1609.344 / 3.785411784e-3, 0},
+	"kilometer_per_liter":      {"kilometer_per_liter", "km/L", []string{"kmpl", "kilometer_per_liter", "kilometers_per_liter"}, "fuel_economy", math.Pow10(6), 0},
+	"liter_per_100_kilometers": {"liter_per_100_kilometers", "L/100km", []string{"L/100km", "l/100km", "liter_per_100_kilometers", "liters_per_100_kilometers"}, "fuel_consumption", math.Pow10(-8), 0},
+
 	// metric weight
-	"kilogram":  {"kilogram", "kg", []string{"kg", "kilogram"}, "kilogram", 1, 0},
-	"hectogram": {"hectogram", "hg", []string{"hg", "hectogram"}, "kilogram", math.Pow10(-1), 0},
-	"decagram":  {"decagram", "dag", []string{"dag", "decagram"}, "kilogram", math.Pow10(-2), 0},
-	"gram":      {"gram", "g", []string{"g", "gram"}, "kilogram", math.Pow10(-3), 0},
-	"decigram":  {"decigram", "dg", []string{"dg", "decigram"}, "kilogram", math.Pow10(-4), 0},
-	"centigram": {"centigram", "cg", []string{"cg", "centigram"}, "kilogram", math.Pow10(-5), 0},
-	"milligram": {"milligram", "mg", []string{"mg", "milligram"}, "kilogram", math.Pow10(-6), 0},
-	"microgram": {"microgram", "µg", []string{"µg", "microgram"}, "kilogram", math.Pow10(-6), 0},
-	"tonne":     {"tonne", "ton", []string{"MG", "megagram", "tonne", "ton"}, "kilogram", math.Pow10(3), 0},
+	"kilogram": {"kilogram", "kg", []string{"kg", "kilogram"}, "kilogram", 1, 0},
+	"gram":     {"gram", "g", []string{"g", "gram"}, "kilogram", math.Pow10(-3), 0},
+	"tonne":    {"tonne", "ton", []string{"MG", "megagram", "tonne", "ton"}, "kilogram", math.Pow10(3), 0},
 	// imperial weight
 	"pound": {"pound", "lbs", []string{"lbs", "pound", "pounds"}, "kilogram", 0.45359237, 0},
 	"ounce": {"ounce", "oz", []string{"oz", "ounce", "ounces"}, "kilogram", 0.028349523125, 0},
 
 	// time
-	"second":      {"second", "s", []string{"s", "second", "seconds"}, "second", 1, 0},
-	"millisecond": {"millisecond", "ms", []string{"ms", "millisecond", "milliseconds"}, "second", math.Pow10(-3), 0},
-	"minute":      {"minute", "min", []string{"min", "minute", "minutes"}, "second", 60, 0},
-	"hour":        {"hour", "hours", []string{"hour", "hours"}, "second", 3600, 0},
-	"day":         {"day", "days", []string{"day", "day", "days"}, "second", 86400, 0},
-	"month":       {"month", "month", []string{"month", "months"}, "second", 2592000, 0},
-	"year":        {"year", "year", []string{"year", "years"}, "second", 31556952, 0},
+	"second":  {"second", "s", []string{"s", "second", "seconds"}, "second", 1, 0},
+	"minute":  {"minute", "min", []string{"min", "minute", "minutes"}, "second", 60, 0},
+	"hour":    {"hour", "hours", []string{"h", "hr", "hour", "hours"}, "second", 3600, 0},
+	"day":     {"day", "days", []string{"day", "days"}, "second", 86400, 0},
+	"week":    {"week", "week", []string{"wk", "week", "weeks"}, "second", 604800, 0},
+	"month":   {"month", "month", []string{"month", "months"}, "second", 2592000, 0},
+	"year":    {"year", "year", []string{"year", "years"}, "second", 31556952, 0},
+	"decade":  {"decade", "decade", []string{"decade", "decades"}, "second", 315569520, 0},
+	"century": {"century", "century", []string{"century", "centuries"}, "second", 3155695200, 0},
+
+	// frequency
+	"hertz": {"hertz", "Hz", []string{"Hz", "hertz"}, "hertz", 1, 0},
 
 	// temperature
 	"celsius":    {"celsius", "°C", []string{"C", "°C", "celsius"}, "celsius", 1, 0},
 	"fahrenheit": {"fahrenheit", "°F", []string{"F", "°F", "fahrenheit"}, "celsius", float64(5) / 9, -32},
 	"kelvin":     {"kelvin", "K", []string{"K", "kelvin"}, "celsius", 1, -273.15},
 
-	// electic current
-	"ampere": {"ampere", "A", []string{"A"}, "ampere", 1, 0},
-
-	// currencies (exchange rates overridden at runtime with exchangeratesapi.io)
+	// force
+	"newton": {"newton", "N", []string{"N", "newton", "newtons"}, "newton", 1, 0},
+
+	// energy
+	"joule":         {"joule", "J", []string{"J", "joule", "joules"}, "joule", 1, 0},
+	"calorie":       {"calorie", "cal", []string{"cal", "calorie", "calories"}, "joule", 4.184, 0},
+	"kilocalorie":   {"kilocalorie", "kcal", []string{"kcal", "kilocalorie", "kilocalories"}, "joule", 4184, 0},
+	"watt_hour":     {"watt_hour", "Wh", []string{"Wh", "watt_hour", "watt_hours"}, "joule", 3600, 0},
+	"kilowatt_hour": {"kilowatt_hour", "kWh", []string{"kWh", "kilowatt_hour", "kilowatt_hours"}, "joule", 3.6 * math.Pow10(6), 0},
+	"btu":           {"btu", "BTU", []string{"BTU", "btu"}, "joule", 1055.05585262, 0},
+
+	// power
+	"watt":       {"watt", "W", []string{"W", "watt", "watts"}, "watt", 1, 0},
+	"horsepower": {"horsepower", "hp", []string{"hp", "horsepower"}, "watt", 745.7, 0},
+
+	// electricity (C and F are reserved to temperatures, coulombs and farads must be written in full)
+	"ampere":     {"ampere", "A", []string{"A", "ampere", "amperes"}, "ampere", 1, 0},
+	"volt":       {"volt", "V", []string{"V", "volt", "volts"}, "volt", 1, 0},
+	"ohm":        {"ohm", "Ω", []string{"Ω", "ohm", "ohms"}, "ohm", 1, 0},
+	"kiloohm":    {"kiloohm", "kΩ", []string{"kΩ", "kohm", "kiloohm", "kiloohms"}, "ohm", math.Pow10(3), 0},
+	"coulomb":    {"coulomb", "coulomb", []string{"coulomb", "coulombs"}, "coulomb", 1, 0},
+	"farad":      {"farad", "farad", []string{"farad", "farads"}, "farad", 1, 0},
+	"microfarad": {"microfarad", "µF", []string{"µF", "uF", "microfarad", "microfarads"}, "farad", math.Pow10(-6), 0},
+
+	// amount of substance
+	"mole": {"mole", "mol", []string{"mol", "mole", "moles"}, "mole", 1, 0},
+
+	// currencies (default exchange rates, the server can override them with exchangeratesapi.io)
 	"eur": {"eur", "€", []string{"€", "eur", "EUR"}, "eur", 1, 0},
 	"usd": {"usd", "$", []string{"$", "usd", "USD"}, "eur", 0.84, 0},
 	"gbp": {"gbp", "£", []string{"£", "gbp", "GBP"}, "eur", 1.17, 0},
-	"cny": {"cny", "¥", []string{"cny", "CNY"}, "eur", 0.13, 0},
+	"cny": {"cny", "¥", []string{"¥", "cny", "CNY"}, "eur", 0.13, 0},
 	"cad": {"cad", "CAD", []string{"cad", "CAD"}, "eur", 0.67, 0},
 
-	// degrees
-	"radians": {"radians", "rad", []string{"rad", "radians"}, "radians", 1, 0},
-	"degrees": {"degrees", "deg", []string{"deg", "degrees"}, "radians", math.Pi / 180, 0},
+	// angles
+	"radians":  {"radians", "rad", []string{"rad", "radian", "radians"}, "radians", 1, 0},
+	"degrees":  {"degrees", "deg", []string{"deg", "°", "degree", "degrees"}, "radians", math.Pi / 180, 0},
+	"gradians": {"gradians", "grad", []string{"grad", "gon", "gradian", "gradians"}, "radians", math.Pi / 200, 0},
 
 	// pressure
 	"pascal":                {"pascal", "Pa", []string{"Pa", "pascal"}, "pascal", 1, 0},
-	"bar":                   {"bar", "bar", []string{"bar"}, "bar", 100_000, 0},
+	"bar":                   {"bar", "bar", []string{"bar"}, "pascal", 100_000, 0},
 	"atmosphere":            {"atmosphere", "atm", []string{"atm", "atmosphere"}, "pascal", 101325, 0},
 	"millimeter_of_mercury": {"millimeter_of_mercury", "mmHg", []string{"millimeter_of_mercury", "mmHg"}, "pascal", float64(101325) / 760, 0},
 
 	// Data
-	"bit":      {"bit", "bit", []string{"b", "bit"}, "bit", 1, 0},
-	"byte":     {"byte", "B", []string{"B", "byte"}, "bit", 8, 0},
-	"kilobit":  {"kilobit", "kbit", []string{"kbit", "kb", "kilobit"}, "bit", math.Pow10(3), 0},
-	"kibibit":  {"kibibit", "Kibit", []string{"Kib", "Kibit", "kibibit"}, "bit", (1 << 10), 0},
-	"kilobyte": {"kilobyte", "kB", []string{"kB", "kilobyte"}, "bit", 8 * math.Pow10(3), 0},
-	"kibibyte": {"kibibyte", "KiB", []string{"KiB", "kibibyte"}, "bit", 8 * (1 << 10), 0},
-	"megabit":  {"megabit", "Mbit", []string{"Mbit", "megabit"}, "bit", math.Pow10(6), 0},
-	"mebibit":  {"mebibit", "Mibit", []string{"Mibit", "mebibit"}, "bit", (1 << 20), 0},
-	"megabyte": {"megabyte", "MB", []string{"MB", "megabyte"}, "bit", 8 * math.Pow10(6), 0},
-	"mebibyte": {"mebibyte", "MiB", []string{"MiB", "mebibyte"}, "bit", 8 * (1 << 20), 0},
-	"gigabit":  {"gigabit", "Gbit", []string{"Gbit", "gigabit"}, "bit", math.Pow10(9), 0},
-	"gibibit":  {"gibibit", "Gibit", []string{"Gibit", "gibibit"}, "bit", (1 << 30), 0},
-	"gigabyte": {"gigabyte", "GB", []string{"GB", "gigabyte"}, "bit", 8 * math.Pow10(9), 0},
-	"gibibyte": {"gibibyte", "GiB", []string{"GiB", "gibibyte"}, "bit", 8 * (1 << 30), 0},
-	"terabit":  {"terabit", "Tbit", []string{"Tbit", "terabit"}, "bit", math.Pow10(12), 0},
-	"tebibit":  {"tebibit", "Tibit", []string{"Tibit", "tibibit"}, "bit", (1 << 40), 0},
-	"terabyte": {"terabyte", "TB", []string{"TB", "terabyte"}, "bit", 8 * math.Pow10(12), 0},
-	"tebibyte": {"tebibyte", "TiB", []string{"TiB", "tibibyte"}, "bit", 8 * (1 << 40), 0},
-	"petabit":  {"petabit", "Pbit", []string{"Pbit", "petabit"}, "bit", math.Pow10(15), 0},
-	"pebibit":  {"pebibit", "Pibit", []string{"Pibit", "pebibit"}, "bit", (1 << 50), 0},
-	"petabyte": {"petabyte", "PB", []string{"PB", "petabyte"}, "bit", 8 * math.Pow10(15), 0},
-	"pebibyte": {"pebibyte", "PiB", []string{"PiB", "pebibyte"}, "bit", 8 * (1 << 50), 0},
+	"bit":      {"bit", "bit", []string{"b", "bit", "bits"}, "byte", float64(1) / 8, 0},
+	"byte":     {"byte", "B", []string{"B", "byte", "bytes"}, "byte", 1, 0},
+	"kilobit":  {"kilobit", "kbit", []string{"kbit", "kb", "kilobit"}, "byte", math.Pow10(3) / 8, 0},
+	"kibibit":  {"kibibit", "Kibit", []string{"Kib", "Kibit", "kibibit"}, "byte", (1 << 10) / 8, 0},
+	"kilobyte": {"kilobyte", "kB", []string{"kB", "KB", "kilobyte"}, "byte", math.Pow10(3), 0},
+	"kibibyte": {"kibibyte", "KiB", []string{"KiB", "kibibyte"}, "byte", (1 << 10), 0},
+	"megabit":  {"megabit", "Mbit", []string{"Mbit", "megabit"}, "byte", math.Pow10(6) / 8, 0},
+	"mebibit":  {"mebibit", "Mibit", []string{"Mibit", "mebibit"}, "byte", (1 << 20) / 8, 0},
+	"megabyte": {"megabyte", "MB", []string{"MB", "megabyte"}, "byte", math.Pow10(6), 0},
+	"mebibyte": {"mebibyte", "MiB", []string{"MiB", "mebibyte"}, "byte", (1 << 20), 0},
+	"gigabit":  {"gigabit", "Gbit", []string{"Gbit", "gigabit"}, "byte", math.Pow10(9) / 8, 0},
+	"gibibit":  {"gibibit", "Gibit", []string{"Gibit", "gibibit"}, "byte", (1 << 30) / 8, 0},
+	"gigabyte": {"gigabyte", "GB", []string{"GB", "gigabyte"}, "byte", math.Pow10(9), 0},
+	"gibibyte": {"gibibyte", "GiB", []string{"GiB", "gibibyte"}, "byte", (1 << 30), 0},
+	"terabit":  {"terabit", "Tbit", []string{"Tbit", "terabit"}, "byte", math.Pow10(12) / 8, 0},
+	"tebibit":  {"tebibit", "Tibit", []string{"Tibit", "tebibit"}, "byte", (1 << 40) / 8, 0},
+	"terabyte": {"terabyte", "TB", []string{"TB", "terabyte"}, "byte", math.Pow10(12), 0},
+	"tebibyte": {"tebibyte", "TiB", []string{"TiB", "tebibyte"}, "byte", (1 << 40), 0},
+	"petabit":  {"petabit", "Pbit", []string{"Pbit", "petabit"}, "byte", math.Pow10(15) / 8, 0},
+	"pebibit":  {"pebibit", "Pibit", []string{"Pibit", "pebibit"}, "byte", (1 << 50) / 8, 0},
+	"petabyte": {"petabyte", "PB", []string{"PB", "petabyte"}, "byte", math.Pow10(15), 0},
+	"pebibyte": {"pebibyte", "PiB", []string{"PiB", "pebibyte"}, "byte", (1 << 50), 0},
+})
+
+// DerivedBaseUnits maps the base units of derived quantities to their decomposition in fundamental base units
+var DerivedBaseUnits map[string]map[string]float64 = map[string]map[string]float64{
+	"square_meter":     {"meter": 2},
+	"cubic_meter":      {"meter": 3},
+	"meter_per_second": {"meter": 1, "second": -1},
+	"hertz":            {"second": -1},
+	"newton":           {"kilogram": 1, "meter": 1, "second": -2},
+	"joule":            {"kilogram": 1, "meter": 2, "second": -2},
+	"watt":             {"kilogram": 1, "meter": 2, "second": -3},
+	"pascal":           {"kilogram": 1, "meter": -1, "second": -2},
+	"volt":             {"kilogram": 1, "meter": 2, "second": -3, "ampere": -1},
+	"ohm":              {"kilogram": 1, "meter": 2, "second": -3, "ampere": -2},
+	"coulomb":          {"second": 1, "ampere": 1},
+	"farad":            {"kilogram": -1, "meter": -2, "second": 4, "ampere": 2},
+	"fuel_economy":     {"meter": -2},
+	"fuel_consumption": {"meter": 2},
 }
 
+// ReciprocalBaseUnits lists the base units whose units also convert to the inverse dimension, e.g. a fuel economy
+// in mpg to a fuel consumption in L/100km, where doubling the distance per volume halves the volume per distance
+var ReciprocalBaseUnits = []string{"fuel_economy", "fuel_consumption"}
+
 func LoadUnitAliases() {
 	for _, unit := range UnitTable {
 		for _, str := range unit.Aliases {
@@ -124,6 +282,41 @@ func LoadUnitAliases() {
 	}
 }
 
+// CurrencyRates validates the rates of the currencies relative to the euro, e.g. {"USD": 1.19}, returning them by
+// currency ID along with the codes that are not known currencies or have an invalid rate
+func CurrencyRates(rates map[string]float64) (map[string]float64, []string) {
+	valid := map[string]float64{}
+	ignored := []string{}
+
+	for code, rate := range rates {
+		unit, ok := UnitTable[strings.ToLower(code)]
+
+		if !ok || unit.BaseUnit != "eur" || unit.ID == "eur" || rate <= 0 {
+			ignored = append(ignored, code)
+			continue
+		}
+
+		valid[unit.ID] = rate
+	}
+
+	sort.Strings(ignored)
+
+	return valid, ignored
+}
+
+// UnitResult is the serializable description of a unit
+type UnitResult struct {
+	ID           string   `json:"id"`
+	DisplayValue string   `json:"displayValue"`
+	Aliases      []string `json:"aliases"`
+	Rate         float64  `json:"rate,omitempty"` // rate relative to the euro, only for the currencies
+}
+
+// UnitsByBaseUnit lists the units of the UnitTable grouped by their base unit and sorted by ID
+func UnitsByBaseUnit() map[string][]UnitResult {
+	return (&ExecutionGraph{}).UnitsByBaseUnit()
+}
+
 func (u FundamentalUnit) String() string {
 	return u.DisplayValue
 }
@@ -161,17 +354,71 @@ func (cu *CompositeUnit) IsEmpty() bool {
 	return len(cu.UnitsList) == 0
 }
 
+// Dimensions decomposes the unit into the exponents of the fundamental base units, expanding derived base units
+func (cu CompositeUnit) Dimensions() map[string]float64 {
+	dimensions := map[string]float64{}
+
+	for _, factor := range cu.UnitsList {
+		if derived, ok := DerivedBaseUnits[factor.Unit.BaseUnit]; ok {
+			for baseUnit, exp := range derived {
+				dimensions[baseUnit] += exp * factor.Exponent
+			}
+		} else {
+			dimensions[factor.Unit.BaseUnit] += factor.Exponent
+		}
+	}
+
+	for baseUnit, exp := range dimensions {
+		if exp == 0 {
+			delete(dimensions, baseUnit)
+		}
+	}
+
+	return dimensions
+}
+
+// Normalize drops the units with a zero exponent, so that a unit cancelling out becomes dimensionless
+func (cu *CompositeUnit) Normalize() {
+	normalized := []UnitExponent{}
+
+	for _, factor := range cu.UnitsList {
+		if factor.Exponent != 0 {
+			normalized = append(normalized, factor)
+		}
+	}
+
+	cu.UnitsList = normalized
+}
+
+// IsCompatible returns whether the two units measure the same dimension, e.g. kg m / s^2 and N
 func (cu CompositeUnit) IsCompatible(other CompositeUnit) bool {
-	cu.Sort()
-	other.Sort()
+	dimensions := cu.Dimensions()
+	otherDimensions := other.Dimensions()
 
+	if len(dimensions) != len(otherDimensions) {
+		return false
+	}
+
+	for baseUnit, exp := range dimensions {
+		if otherDimensions[baseUnit] != exp {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Equals returns whether the two composite units are made of the same units with the same exponents
+func (cu CompositeUnit) Equals(other CompositeUnit) bool {
 	if len(cu.UnitsList) != len(other.UnitsList) {
 		return false
 	}
 
-	for i := 0; i < len(cu.UnitsList); i++ {
-		if cu.UnitsList[i].Exponent != other.UnitsList[i].Exponent ||
-			!AreUnitsCompatible(cu.UnitsList[i].Unit, other.UnitsList[i].Unit) {
+	cu.Sort()
+	other.Sort()
+
+	for i := range cu.UnitsList {
+		if cu.UnitsList[i].Unit.ID != other.UnitsList[i].Unit.ID || cu.UnitsList[i].Exponent != other.UnitsList[i].Exponent {
 			return false
 		}
 	}
@@ -179,6 +426,65 @@ func (cu CompositeUnit) IsCompatible(other CompositeUnit) bool {
 	return true
 }
 
+// radiansUnit is the composite unit the angles are converted to
+var radiansUnit = CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["radians"], Exponent: 1}}}
+
+// Checks whether the unit measures an angle, comparing its dimension instead of its name, so that
+// composite units reducing to an angle, e.g. deg m / m, are recognized as well
+func (cu CompositeUnit) isAngle() bool {
+	if cu.IsEmpty() {
+		return false
+	}
+
+	_, err := ConvertCompositeUnits(1, cu, radiansUnit)
+	return err == nil
+}
+
+// Checks whether any of the units is an affine scale, i.e. has a non-zero conversion shift
+func (cu CompositeUnit) hasConversionShift() bool {
+	for _, unit := range cu.UnitsList {
+		if unit.Unit.ConversionShift != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks whether any of the units is a temperature scale whose zero is not the absolute zero, e.g. °C or °F
+// but not K, so that its values cannot be multiplied
+func (cu CompositeUnit) hasOffsetScale() bool {
+	for _, unit := range cu.UnitsList {
+		if unit.Unit.BaseUnit == "celsius" && unit.Unit.ID != "kelvin" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks whether any of the units belongs to the ReciprocalBaseUnits
+func (cu CompositeUnit) isReciprocal() bool {
+	for _, unit := range cu.UnitsList {
+		if containsString(ReciprocalBaseUnits, unit.Unit.BaseUnit) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Computes the factor converting a value in this unit to the same value in the base units
+func (cu CompositeUnit) conversionFactor() float64 {
+	factor := float64(1)
+
+	for _, unit := range cu.UnitsList {
+		factor *= math.Pow(unit.Unit.ConversionFactor, unit.Exponent)
+	}
+
+	return factor
+}
+
 func (cu *CompositeUnit) Sort() {
 	sort.Slice(cu.UnitsList, func(i int, j int) bool {
 		if cu.UnitsList[i].Exponent > 0 && cu.UnitsList[j].Exponent < 0 {
@@ -201,50 +507,159 @@ func (cu *CompositeUnit) SortByBaseUnitName() {
 
 func (cu CompositeUnit) String() string {
 	cu.Sort()
-	s := ""
+	numerator, denominator := []string{}, []string{}
 
-	positive := true
 	for _, factor := range cu.UnitsList {
-		if positive && factor.Exponent < 0 {
-			if s == "" {
-				s = "1"
-			}
-
-			s += " /"
-		}
-
-		if s != "" {
-			s += " "
-		}
-
 		exp := factor.Exponent
 		if exp < 0 {
 			exp = -exp
 		}
 
+		unit := factor.Unit.String()
 		if exp != 1 {
-			s += fmt.Sprintf("%s^%s", factor.Unit.String(), strconv.FormatFloat(exp, 'f', -1, 32))
+			unit = fmt.Sprintf("%s^%s", unit, strconv.FormatFloat(exp, 'f', -1, 32))
+		}
+
+		if factor.Exponent < 0 {
+			denominator = append(denominator, unit)
 		} else {
-			s += factor.Unit.String()
+			numerator = append(numerator, unit)
 		}
 	}
 
-	return s
+	if len(denominator) == 0 {
+		return strings.Join(numerator, " ")
+	}
+	if len(numerator) == 0 {
+		numerator = []string{"1"}
+	}
+
+	// the units of the denominator are grouped, e.g. kg / (m s^2)
+	if len(denominator) > 1 {
+		return strings.Join(numerator, " ") + " / (" + strings.Join(denominator, " ") + ")"
+	}
+
+	return strings.Join(numerator, " ") + " / " + denominator[0]
 }
 
 func ConvertCompositeUnits(value float64, from CompositeUnit, to CompositeUnit) (float64, error) {
 	if !from.IsCompatible(to) {
 		return 0, fmt.Errorf("Units are not compatible")
 	}
-	from.Sort()
-	to.Sort()
 
-	// BUG: composite units containing temperatures are broken
-	for i := 0; i < len(from.UnitsList); i++ {
-		value = ConvertFundamentalUnits(value, from.UnitsList[i].Unit, to.UnitsList[i].Unit, from.UnitsList[i].Exponent)
+	// single units are converted directly, so that the shift of temperatures is applied
+	if len(from.UnitsList) == 1 && len(to.UnitsList) == 1 &&
+		from.UnitsList[0].Exponent == 1 && to.UnitsList[0].Exponent == 1 &&
+		AreUnitsCompatible(from.UnitsList[0].Unit, to.UnitsList[0].Unit) {
+		return ConvertFundamentalUnits(value, from.UnitsList[0].Unit, to.UnitsList[0].Unit, 1), nil
+	}
+
+	if from.Equals(to) {
+		return value, nil
+	}
+
+	// shifted scales (e.g. temperatures) have no meaning when combined with other units or exponentiated
+	if from.hasConversionShift() || to.hasConversionShift() {
+		return 0, fmt.Errorf("Units with an offset, like temperatures, cannot be converted when combined with other units")
+	}
+
+	return value * from.conversionFactor() / to.conversionFactor(), nil
+}
+
+// ConvertCompositeUnitsExplicitly converts a value like ConvertCompositeUnits for an explicit conversion, e.g.
+// `x in [L/100km]`, which also converts between the ReciprocalBaseUnits, e.g. a fuel economy to a fuel consumption,
+// while the operations mixing them, e.g. (1 [mpg]) + (1 [L/100km]), are an error
+func ConvertCompositeUnitsExplicitly(value float64, from CompositeUnit, to CompositeUnit) (float64, error) {
+	if !from.IsCompatible(to) && (from.isReciprocal() || to.isReciprocal()) &&
+		from.IsCompatible(CompositeUnitExponentiation(to, -1)) {
+		if value == 0 {
+			return 0, fmt.Errorf("Division by zero")
+		}
+
+		return 1 / (value * from.conversionFactor()) / to.conversionFactor(), nil
+	}
+
+	return ConvertCompositeUnits(value, from, to)
+}
+
+// ConvertCompositeUnitsInterval converts a difference between two values, e.g. the 3 K of 5 [°C] + 3 [K], which is
+// the same in °C and K, so the shift of the temperatures is not applied
+func ConvertCompositeUnitsInterval(value float64, from CompositeUnit, to CompositeUnit) (float64, error) {
+	if !from.hasConversionShift() && !to.hasConversionShift() {
+		return ConvertCompositeUnits(value, from, to)
+	}
+
+	if !from.IsCompatible(to) {
+		return 0, fmt.Errorf("Units are not compatible")
+	}
+
+	return value * from.conversionFactor() / to.conversionFactor(), nil
+}
+
+// NamedDerivedUnits lists the derived units that composite units can be simplified to
+var NamedDerivedUnits = []string{"newton", "joule", "watt", "pascal", "volt", "ohm", "coulomb", "farad"}
+
+// SimplifyCompositeUnit expresses a composite unit as the named derived unit with the same dimensions,
+// e.g. kg m / s^2 as N, converting the value accordingly
+func SimplifyCompositeUnit(value float64, cu CompositeUnit) (float64, CompositeUnit) {
+	if len(cu.UnitsList) < 2 || cu.hasConversionShift() {
+		return value, cu
 	}
 
-	return value, nil
+	for _, id := range NamedDerivedUnits {
+		named := CompositeUnit{UnitsList: []UnitExponent{{UnitTable[id], 1}}}
+
+		if named.IsCompatible(cu) {
+			converted, err := ConvertCompositeUnits(value, cu, named)
+
+			if err == nil {
+				return converted, named
+			}
+		}
+	}
+
+	return value, cu
+}
+
+// SIPrefixes lists the prefixes used to scale displayed units, from the smallest to the largest
+var SIPrefixes = []string{"femto", "pico", "nano", "micro", "milli", "", "kilo", "mega", "giga", "tera"}
+
+// ScaleSIPrefix expresses a single metric unit with the SI prefix that brings the value between 1 and 1000,
+// e.g. 0,0000034 m as 3,4 μm, among the prefixed units available in the UnitTable
+func ScaleSIPrefix(value float64, cu CompositeUnit) (float64, CompositeUnit) {
+	if len(cu.UnitsList) != 1 || cu.UnitsList[0].Exponent != 1 || cu.hasConversionShift() || value == 0 {
+		return value, cu
+	}
+
+	unit := cu.UnitsList[0].Unit
+	root := unit.ID
+	for _, prefix := range SIPrefixes {
+		if prefix != "" && strings.HasPrefix(unit.ID, prefix) {
+			root = unit.ID[len(prefix):]
+		}
+	}
+
+	if _, ok := UnitTable[root]; !ok {
+		return value, cu
+	}
+
+	// the largest prefix that keeps the value at least 1, or the smallest available one
+	scaledUnit, found := unit, false
+	for _, prefix := range SIPrefixes {
+		candidate, ok := UnitTable[prefix+root]
+
+		if !ok || candidate.BaseUnit != unit.BaseUnit {
+			continue
+		}
+
+		if !found || math.Abs(value*unit.ConversionFactor/candidate.ConversionFactor) >= 1 {
+			scaledUnit, found = candidate, true
+		}
+	}
+
+	scaled := value * unit.ConversionFactor / scaledUnit.ConversionFactor
+
+	return scaled, CompositeUnit{UnitsList: []UnitExponent{{scaledUnit, 1}}}
 }
 
 func CompositeUnitExponentiation(cu CompositeUnit, exp float64) CompositeUnit {
@@ -255,6 +670,7 @@ func CompositeUnitExponentiation(cu CompositeUnit, exp float64) CompositeUnit {
 			Exponent: cu.UnitsList[i].Exponent * exp,
 		})
 	}
+	newUnit.Normalize()
 
 	return newUnit
 }
@@ -301,12 +717,17 @@ func CompositeUnitProduct(valueA float64, valueB float64, a CompositeUnit, b Com
 		}
 	}
 
+	product.Normalize()
 	product.Sort()
 
 	return value, product
 }
+
 func CompositeUnitDivision(valueA float64, valueB float64, a CompositeUnit, b CompositeUnit) (float64, CompositeUnit) {
 	b = CompositeUnitExponentiation(b, -1)
 
-	return CompositeUnitProduct(valueA, 1/valueB, a, b)
+	value, quotient := CompositeUnitProduct(valueA, 1/valueB, a, b)
+	quotient.Normalize()
+
+	return value, quotient
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"strings"
 	"testing"
 )
 
@@ -37,6 +38,36 @@ func TestCompositeUnitString(t *testing.T) {
 	if cu.String() != "€ / m^2" {
 		t.Errorf("Composite unit string should be € / m^2, %s was returned instead", cu.String())
 	}
+
+	cu = CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["second"], Exponent: -2},
+			{Unit: UnitTable["kilogram"], Exponent: 1},
+			{Unit: UnitTable["meter"], Exponent: -1},
+		},
+	}
+
+	if cu.String() != "kg / (m s^2)" {
+		t.Errorf("Composite unit string should be kg / (m s^2), %s was returned instead", cu.String())
+	}
+
+	// the grouped denominator is parsed back to the same unit
+	LoadUnitAliases()
+	if parsed, err := ParseUnit(cu.String()); err != nil || parsed.String() != cu.String() {
+		t.Errorf("kg / (m s^2) should be parsed back, got %s (%v) instead", parsed, err)
+	}
+
+	cu = CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["second"], Exponent: -1},
+			{Unit: UnitTable["ampere"], Exponent: -1},
+			{Unit: UnitTable["mole"], Exponent: -3},
+		},
+	}
+
+	if cu.String() != "1 / (A mol^3 s)" {
+		t.Errorf("Composite unit string should be 1 / (A mol^3 s), %s was returned instead", cu.String())
+	}
 }
 
 func TestSort(t *testing.T) {
@@ -93,8 +124,330 @@ func TestFundamentalUnitConversion(t *testing.T) {
 		t.Errorf("1 m^2 should convert to 10.000 cm^2, got %f instead", got)
 	}
 
+	got = ConvertFundamentalUnits(1, UnitTable["gram"], UnitTable["microgram"], 1)
+	if math.Abs(got-1_000_000) > 1e-6 {
+		t.Errorf("1 gram should convert to 1.000.000 micrograms, got %f instead", got)
+	}
+
 	got = ConvertFundamentalUnits(90, UnitTable["degrees"], UnitTable["radians"], 1)
 	if got != math.Pi/2 {
 		t.Errorf("90 deg should convert to pi/2 rad, got %f instead", got)
 	}
 }
+
+func TestEnergyUnits(t *testing.T) {
+	got := ConvertFundamentalUnits(1, UnitTable["kilowatt_hour"], UnitTable["kilojoule"], 1)
+	if got != 3600 {
+		t.Errorf("1 kWh should convert to 3600 kJ, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(1, UnitTable["kilocalorie"], UnitTable["joule"], 1)
+	if got != 4184 {
+		t.Errorf("1 kcal should convert to 4184 J, got %f instead", got)
+	}
+
+	cu := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["kilowatt_hour"], Exponent: 1},
+			{Unit: UnitTable["day"], Exponent: -1},
+		},
+	}
+
+	if cu.String() != "kWh / days" {
+		t.Errorf("Composite unit string should be kWh / days, %s was returned instead", cu.String())
+	}
+}
+
+func TestPowerUnits(t *testing.T) {
+	got := ConvertFundamentalUnits(2, UnitTable["horsepower"], UnitTable["kilowatt"], 1)
+	if got != 1.4914 {
+		t.Errorf("2 hp should convert to 1.4914 kW, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(3, UnitTable["megawatt"], UnitTable["milliwatt"], 1)
+	if got != 3*math.Pow10(9) {
+		t.Errorf("3 MW should convert to 3e9 mW, got %f instead", got)
+	}
+}
+
+func TestDerivedUnitsCompatibility(t *testing.T) {
+	newton := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["newton"], Exponent: 1}}}
+	kgMeterPerSecondSquared := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["kilogram"], Exponent: 1},
+			{Unit: UnitTable["meter"], Exponent: 1},
+			{Unit: UnitTable["second"], Exponent: -2},
+		},
+	}
+
+	if !newton.IsCompatible(kgMeterPerSecondSquared) {
+		t.Errorf("N should be compatible with kg m / s^2")
+	}
+
+	got, err := ConvertCompositeUnits(3, kgMeterPerSecondSquared, newton)
+	if err != nil || got != 3 {
+		t.Errorf("3 kg m / s^2 should convert to 3 N, got %f (%v) instead", got, err)
+	}
+
+	kilonewton := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["kilonewton"], Exponent: 1}}}
+	gramCentimeterPerSecondSquared := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["gram"], Exponent: 1},
+			{Unit: UnitTable["centimeter"], Exponent: 1},
+			{Unit: UnitTable["second"], Exponent: -2},
+		},
+	}
+
+	got, err = ConvertCompositeUnits(2, kilonewton, gramCentimeterPerSecondSquared)
+	if err != nil || math.Abs(got-2*math.Pow10(8)) > 1e-6 {
+		t.Errorf("2 kN should convert to 2e8 g cm / s^2, got %f (%v) instead", got, err)
+	}
+
+	kilowattHour := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["kilowatt_hour"], Exponent: 1}}}
+	wattSecond := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["watt"], Exponent: 1},
+			{Unit: UnitTable["second"], Exponent: 1},
+		},
+	}
+
+	got, err = ConvertCompositeUnits(1, kilowattHour, wattSecond)
+	if err != nil || got != 3.6*math.Pow10(6) {
+		t.Errorf("1 kWh should convert to 3.6e6 W s, got %f (%v) instead", got, err)
+	}
+
+	if newton.IsCompatible(kilowattHour) {
+		t.Errorf("N should not be compatible with kWh")
+	}
+}
+
+func TestDataUnits(t *testing.T) {
+	got := ConvertFundamentalUnits(16, UnitTable["bit"], UnitTable["byte"], 1)
+	if got != 2 {
+		t.Errorf("16 bit should convert to 2 B, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(1, UnitTable["gibibyte"], UnitTable["mebibyte"], 1)
+	if got != 1024 {
+		t.Errorf("1 GiB should convert to 1024 MiB, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(1, UnitTable["gigabyte"], UnitTable["megabyte"], 1)
+	if got != 1000 {
+		t.Errorf("1 GB should convert to 1000 MB, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(1, UnitTable["megabyte"], UnitTable["megabit"], 1)
+	if got != 8 {
+		t.Errorf("1 MB should convert to 8 Mbit, got %f instead", got)
+	}
+
+	cu := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["tebibyte"], Exponent: 1}}}
+	if cu.String() != "TiB" {
+		t.Errorf("Composite unit string should be TiB, %s was returned instead", cu.String())
+	}
+}
+
+func TestVolumeUnits(t *testing.T) {
+	got := ConvertFundamentalUnits(2, UnitTable["liter"], UnitTable["milliliter"], 1)
+	if math.Abs(got-2000) > 1e-9 {
+		t.Errorf("2 L should convert to 2000 mL, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(1, UnitTable["gallon"], UnitTable["cup"], 1)
+	if math.Abs(got-16) > 1e-9 {
+		t.Errorf("1 gal should convert to 16 cups, got %f instead", got)
+	}
+
+	got = ConvertFundamentalUnits(1, UnitTable["tablespoon"], UnitTable["teaspoon"], 1)
+	if math.Abs(got-3) > 1e-9 {
+		t.Errorf("1 tbsp should convert to 3 tsp, got %f instead", got)
+	}
+
+	cubicMeter := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["meter"], Exponent: 3}}}
+	liter := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["liter"], Exponent: 1}}}
+
+	converted, err := ConvertCompositeUnits(1, cubicMeter, liter)
+	if err != nil || math.Abs(converted-1000) > 1e-9 {
+		t.Errorf("1 m^3 should convert to 1000 L, got %f (%v) instead", converted, err)
+	}
+}
+
+func TestTemperatureConversion(t *testing.T) {
+	celsius := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["celsius"], Exponent: 1}}}
+	fahrenheit := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["fahrenheit"], Exponent: 1}}}
+	kelvin := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["kelvin"], Exponent: 1}}}
+
+	got, err := ConvertCompositeUnits(100, celsius, fahrenheit)
+	if err != nil || got != 212 {
+		t.Errorf("100 °C should convert to 212 °F, got %f (%v) instead", got, err)
+	}
+
+	got, err = ConvertCompositeUnits(0, kelvin, celsius)
+	if err != nil || got != -273.15 {
+		t.Errorf("0 K should convert to -273.15 °C, got %f (%v) instead", got, err)
+	}
+
+	fahrenheitPerHour := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["fahrenheit"], Exponent: 1},
+			{Unit: UnitTable["hour"], Exponent: -1},
+		},
+	}
+	celsiusPerHour := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["celsius"], Exponent: 1},
+			{Unit: UnitTable["hour"], Exponent: -1},
+		},
+	}
+
+	_, err = ConvertCompositeUnits(1, fahrenheitPerHour, celsiusPerHour)
+	if err == nil {
+		t.Errorf("Converting °F / hours to °C / hours should fail")
+	}
+
+	squaredKelvin := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["kelvin"], Exponent: 2}}}
+	squaredCelsius := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["celsius"], Exponent: 2}}}
+
+	_, err = ConvertCompositeUnits(1, squaredKelvin, squaredCelsius)
+	if err == nil {
+		t.Errorf("Converting K^2 to °C^2 should fail")
+	}
+}
+
+func TestCompositeUnitDivision(t *testing.T) {
+	cubicMeter := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["meter"], Exponent: 3}}}
+	meter := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["meter"], Exponent: 1}}}
+	centimeter := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["centimeter"], Exponent: 1}}}
+
+	value, unit := CompositeUnitDivision(6, 2, cubicMeter, meter)
+	if value != 3 || unit.String() != "m^2" {
+		t.Errorf("6 m^3 / 2 m should be 3 m^2, got %f %s instead", value, unit)
+	}
+
+	value, unit = CompositeUnitDivision(6, 2, meter, meter)
+	if value != 3 || !unit.IsEmpty() {
+		t.Errorf("6 m / 2 m should be 3 with no unit, got %f %s instead", value, unit)
+	}
+
+	value, unit = CompositeUnitDivision(6, 200, meter, centimeter)
+	if value != 3 || !unit.IsEmpty() {
+		t.Errorf("6 m / 200 cm should be 3 with no unit, got %f %s instead", value, unit)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cu := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["meter"], Exponent: 0},
+			{Unit: UnitTable["second"], Exponent: -1},
+		},
+	}
+	cu.Normalize()
+
+	if cu.String() != "1 / s" {
+		t.Errorf("Normalized composite unit string should be 1 / s, %s was returned instead", cu.String())
+	}
+
+	cu = CompositeUnitExponentiation(CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["meter"], Exponent: 2}}}, 0)
+	if !cu.IsEmpty() {
+		t.Errorf("m^2 raised to 0 should have no unit, got %s instead", cu)
+	}
+}
+
+func TestUnitsByBaseUnit(t *testing.T) {
+	groups := UnitsByBaseUnit()
+
+	found := false
+	for _, unit := range groups["meter"] {
+		if unit.ID == "kilometer" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("kilometer should be listed among the lengths")
+	}
+
+	for base, units := range groups {
+		for _, unit := range units {
+			if UnitTable[unit.ID].BaseUnit != base {
+				t.Errorf("%s should not be listed under %s", unit.ID, base)
+			}
+		}
+	}
+
+	// a graph lists its currency rates and the units declared by its source code
+	graph := ExecutionGraph{SourceCode: "unit furlong = 201,168 [m]", CurrencyRates: map[string]float64{"usd": 1.25}}
+	if err := graph.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	groups = graph.UnitsByBaseUnit()
+
+	found = false
+	for _, unit := range groups["meter"] {
+		if unit.ID == "furlong" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("furlong should be listed among the lengths")
+	}
+
+	for _, unit := range groups["eur"] {
+		if unit.ID == "usd" && math.Abs(unit.Rate-1.25) > 1e-9 {
+			t.Errorf("The rate of usd should be 1.25, got %f instead", unit.Rate)
+		}
+	}
+}
+
+func TestValidCurrencyRates(t *testing.T) {
+	valid, ignored := CurrencyRates(map[string]float64{"USD": 1.25, "xyz": 2, "meter": 3, "EUR": 2, "gbp": -1})
+
+	if len(valid) != 1 || valid["usd"] != 1.25 {
+		t.Errorf("The only valid rate should be 1.25 for usd, got %v instead", valid)
+	}
+
+	if strings.Join(ignored, ",") != "EUR,gbp,meter,xyz" {
+		t.Errorf("The ignored codes should be EUR,gbp,meter,xyz, got %v instead", ignored)
+	}
+}
+
+func TestSimplifyCompositeUnit(t *testing.T) {
+	cu := CompositeUnit{
+		UnitsList: []UnitExponent{
+			{Unit: UnitTable["gram"], Exponent: 1},
+			{Unit: UnitTable["meter"], Exponent: 1},
+			{Unit: UnitTable["second"], Exponent: -2},
+		},
+	}
+
+	value, simplified := SimplifyCompositeUnit(3000, cu)
+	if simplified.String() != "N" || math.Abs(value-3) > 1e-9 {
+		t.Errorf("3000 g m / s^2 should be simplified to 3 N, got %f %s instead", value, simplified)
+	}
+
+	area := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["meter"], Exponent: 2}}}
+	if _, simplified := SimplifyCompositeUnit(1, area); simplified.String() != "m^2" {
+		t.Errorf("m^2 should not be simplified, got %s instead", simplified)
+	}
+}
+
+func TestScaleSIPrefix(t *testing.T) {
+	meters := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["meter"], Exponent: 1}}}
+
+	value, scaled := ScaleSIPrefix(0.0000034, meters)
+	if scaled.String() != "μm" || math.Abs(value-3.4) > 1e-9 {
+		t.Errorf("0,0000034 m should be scaled to 3,4 μm, got %f %s instead", value, scaled)
+	}
+
+	value, scaled = ScaleSIPrefix(-1502, meters)
+	if scaled.String() != "km" || math.Abs(value+1.502) > 1e-9 {
+		t.Errorf("-1502 m should be scaled to -1,502 km, got %f %s instead", value, scaled)
+	}
+
+	miles := CompositeUnit{UnitsList: []UnitExponent{{Unit: UnitTable["mile"], Exponent: 1}}}
+	if value, scaled := ScaleSIPrefix(2000, miles); scaled.String() != "mi" || value != 2000 {
+		t.Errorf("Non metric units should not be scaled, got %f %s instead", value, scaled)
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
-import "math"
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
 
 // Checks if val is contained in the slice
-func containsByte(slice []byte, val byte) bool {
+func containsRune(slice []rune, val rune) bool {
 	for _, item := range slice {
 		if item == val {
 			return true
@@ -12,6 +17,11 @@ func containsByte(slice []byte, val byte) bool {
 	return false
 }
 
+// Checks if the character can start a name: a letter, an underscore or the degree sign of °C
+func isLiteralStart(char rune) bool {
+	return unicode.IsLetter(char) || char == '_' || char == '°'
+}
+
 func containsString(slice []string, val string) bool {
 	for _, item := range slice {
 		if item == val {
@@ -21,7 +31,147 @@ func containsString(slice []string, val string) bool {
 	return false
 }
 
+func containsInt(slice []int, val int) bool {
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes every occurrence of val from the slice
+func removeInt(slice []int, val int) []int {
+	filtered := []int{}
+	for _, item := range slice {
+		if item != val {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// Checks that the thousands separators of a number literal split its integer part in groups of 3 digits,
+// e.g. 1.000.000 but not 3.14159, which would otherwise be read as 314159
+func hasValidGrouping(literal string, thousandsSeparator string, decimalSeparator string) bool {
+	parts := strings.SplitN(strings.TrimSuffix(literal, "%"), decimalSeparator, 2)
+	if len(parts) == 2 && strings.Contains(parts[1], thousandsSeparator) {
+		return false
+	}
+
+	groups := strings.Split(parts[0], thousandsSeparator)
+	for _, group := range groups[1:] {
+		if len(group) != 3 {
+			return false
+		}
+	}
+
+	return len(groups) == 1 || (len(groups[0]) >= 1 && len(groups[0]) <= 3)
+}
+
 func roundToDecimal(val float64, decimals int) float64 {
 	magnitude := math.Pow10(decimals)
 	return math.Round(val*magnitude) / magnitude
 }
+
+// Rounds the value to the given number of significant digits, also returning the number of decimals they span,
+// which is negative when the last significant digit is left of the decimal point, e.g. -2 for 12300 with 3 digits
+func roundToSignificant(val float64, digits int) (float64, int) {
+	if val == 0 || math.IsInf(val, 0) || math.IsNaN(val) {
+		return val, digits - 1
+	}
+
+	magnitude := int(math.Floor(math.Log10(math.Abs(val))))
+	decimals := digits - 1 - magnitude
+	rounded := roundToDecimal(val, decimals)
+
+	// rounding up can add a digit, e.g. 9,96 becomes 10 with 2 digits
+	if int(math.Floor(math.Log10(math.Abs(rounded)))) > magnitude {
+		decimals--
+	}
+
+	return rounded, decimals
+}
+
+// Computes the number of k-combinations of n elements, multiplying the factors one at a time to avoid overflows
+func combinations(n float64, k float64) float64 {
+	if k > n-k {
+		k = n - k
+	}
+
+	// past 1000 factors the result overflows anyway, so it is approximated with the logarithm of the gamma function
+	// instead of looping, which would take forever for huge arguments
+	if k > 1000 {
+		lgammaN, _ := math.Lgamma(n + 1)
+		lgammaK, _ := math.Lgamma(k + 1)
+		lgammaNK, _ := math.Lgamma(n - k + 1)
+
+		return math.Exp(lgammaN - lgammaK - lgammaNK)
+	}
+
+	result := float64(1)
+	for i := float64(1); i <= k; i++ {
+		result = result * (n - k + i) / i
+	}
+
+	return result
+}
+
+// Computes the number of k-permutations of n elements
+func permutations(n float64, k float64) float64 {
+	// the product of more than 170 factors, each at least 1 except the first, overflows float64
+	if k > 170 {
+		return math.Inf(1)
+	}
+
+	// counting the factors rather than looping up to n, since from 2^53 on n-1 cannot be distinguished from n
+	result := float64(1)
+	for i := float64(0); i < k; i++ {
+		result *= n - i
+	}
+
+	return result
+}
+
+// Parses a reference to a line like line12, returning the line number
+func parseLineReference(literal string) (int, bool) {
+	if !strings.HasPrefix(literal, "line") {
+		return 0, false
+	}
+
+	number, err := strconv.Atoi(literal[len("line"):])
+	if err != nil {
+		return 0, false
+	}
+
+	return number, true
+}
+
+// Groups the integer digits of a formatted number, e.g. -1234567.5, in thousands and replaces its decimal point
+func groupThousands(formatted string, thousandsSeparator string, decimalSeparator string) string {
+	sign := ""
+	if strings.HasPrefix(formatted, "-") {
+		sign, formatted = "-", formatted[1:]
+	}
+
+	// the exponent of the scientific notation is kept as it is, e.g. 1e+30
+	exponent := ""
+	if e := strings.Index(formatted, "e"); e >= 0 {
+		formatted, exponent = formatted[:e], formatted[e:]
+	}
+
+	integer, fraction := formatted, ""
+	if point := strings.Index(formatted, "."); point >= 0 {
+		integer, fraction = formatted[:point], decimalSeparator+formatted[point+1:]
+	}
+
+	grouped := integer[:len(integer)%3]
+	for i := len(integer) % 3; i < len(integer); i += 3 {
+		if grouped != "" {
+			grouped += thousandsSeparator
+		}
+		grouped += integer[i : i+3]
+	}
+
+	return sign + grouped + fraction + exponent
+}
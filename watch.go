@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileWatcher reports the changes of a set of files, watching their directories so that the files replaced
+// by the editors when saving, rather than written in place, keep being followed
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	// the absolute paths of the watched files
+	paths map[string]bool
+	// Changes receives a value when the files stop changing for the debounce interval after a change,
+	// so that a file saved with several writes is reported once
+	Changes chan struct{}
+}
+
+// Creates a watcher of the files, reporting the changes that follow its creation
+func newFileWatcher(paths []string, debounce time.Duration) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	fileWatcher := &fileWatcher{watcher: watcher, paths: map[string]bool{}, Changes: make(chan struct{}, 1)}
+	for _, path := range paths {
+		absolute, err := filepath.Abs(path)
+		if err == nil {
+			err = watcher.Add(filepath.Dir(absolute))
+		}
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+
+		fileWatcher.paths[absolute] = true
+	}
+
+	go fileWatcher.debounce(debounce)
+
+	return fileWatcher, nil
+}
+
+// Reports a change once no event of the watched files follows the last one within the interval
+func (watcher *fileWatcher) debounce(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if watcher.paths[filepath.Clean(event.Name)] {
+				timer.Reset(interval)
+			}
+		case _, ok := <-watcher.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			// some events may have been lost, e.g. because of an overflow, so the files are assumed to be changed
+			timer.Reset(interval)
+		case <-timer.C:
+			// a change still waiting to be received already covers this one
+			select {
+			case watcher.Changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Close stops watching the files
+func (watcher *fileWatcher) Close() error {
+	return watcher.watcher.Close()
+}
+
+// Calls onChange whenever any of the files changes, once it has not changed again for the debounce interval,
+// until the process is interrupted
+func watchFiles(paths []string, debounce time.Duration, onChange func()) error {
+	watcher, err := newFileWatcher(paths, debounce)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for range watcher.Changes {
+		onChange()
+	}
+
+	return nil
+}
+
+// Checks whether the files have the same names and number of lines
+func sameSourceFiles(files []SourceFile, others []SourceFile) bool {
+	if len(files) != len(others) {
+		return false
+	}
+
+	for i := range files {
+		if files[i] != others[i] {
+			return false
+		}
+	}
+
+	return true
+}